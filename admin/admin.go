@@ -0,0 +1,48 @@
+package admin
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-hsm/constants"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"net"
+	"net/http"
+	"os"
+)
+
+func Init() (err error) {
+	os.Remove(constants.SockPath)
+
+	listener, err := net.Listen("unix", constants.SockPath)
+	if err != nil {
+		err = &errortypes.WriteError{
+			errors.Wrap(err, "admin: Failed to open admin socket"),
+		}
+		return
+	}
+
+	err = os.Chmod(constants.SockPath, 0600)
+	if err != nil {
+		listener.Close()
+		err = &errortypes.WriteError{
+			errors.Wrap(err, "admin: Failed to chmod admin socket"),
+		}
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/approval", approvalsGet)
+	mux.HandleFunc("/approval/", approvalPut)
+	mux.HandleFunc("/socket", socketsGet)
+
+	go func() {
+		e := http.Serve(listener, mux)
+		if e != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": e,
+			}).Error("admin: Admin server error")
+		}
+	}()
+
+	return
+}
@@ -0,0 +1,59 @@
+package admin
+
+import (
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-hsm/authority"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"net/http"
+	"strings"
+)
+
+func approvalsGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed",
+			errors.New("admin: Method not allowed"))
+		return
+	}
+
+	writeJson(w, http.StatusOK, authority.GetApprovals())
+}
+
+func approvalPut(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed",
+			errors.New("admin: Method not allowed"))
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/approval/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		writeError(w, http.StatusNotFound, "not_found",
+			errors.New("admin: Invalid approval path"))
+		return
+	}
+
+	var err error
+	switch parts[1] {
+	case "approve":
+		err = authority.Approve(parts[0])
+	case "deny":
+		err = authority.Deny(parts[0])
+	default:
+		writeError(w, http.StatusNotFound, "not_found",
+			errors.New("admin: Invalid approval action"))
+		return
+	}
+
+	if err != nil {
+		switch err.(type) {
+		case *errortypes.NotFoundError:
+			writeError(w, http.StatusNotFound, "not_found", err)
+		default:
+			writeError(w, http.StatusInternalServerError,
+				"internal_error", err)
+		}
+		return
+	}
+
+	writeJson(w, http.StatusOK, nil)
+}
@@ -0,0 +1,72 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-hsm/constants"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"net"
+	"net/http"
+	"time"
+)
+
+var client = &http.Client{
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (
+			net.Conn, error) {
+
+			dialer := &net.Dialer{}
+			return dialer.DialContext(ctx, "unix", constants.SockPath)
+		},
+	},
+	Timeout: 10 * time.Second,
+}
+
+func Request(method, path string, output interface{}) (err error) {
+	req, err := http.NewRequest(method, "http://unix"+path, nil)
+	if err != nil {
+		err = &errortypes.RequestError{
+			errors.Wrap(err, "admin: Failed to create request"),
+		}
+		return
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		err = &errortypes.RequestError{
+			errors.Wrap(err, "admin: Failed to connect to admin socket"),
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errData := &errortypes.ErrorData{}
+		e := json.NewDecoder(resp.Body).Decode(errData)
+		if e != nil || errData.Message == "" {
+			err = &errortypes.RequestError{
+				errors.Newf("admin: Request failed with status %d",
+					resp.StatusCode),
+			}
+			return
+		}
+
+		err = &errortypes.RequestError{
+			errors.New(errData.Message),
+		}
+		return
+	}
+
+	if output != nil {
+		err = json.NewDecoder(resp.Body).Decode(output)
+		if err != nil {
+			err = &errortypes.ParseError{
+				errors.Wrap(err, "admin: Failed to parse response"),
+			}
+			return
+		}
+	}
+
+	return
+}
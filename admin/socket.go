@@ -0,0 +1,17 @@
+package admin
+
+import (
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-hsm/socket"
+	"net/http"
+)
+
+func socketsGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed",
+			errors.New("admin: Method not allowed"))
+		return
+	}
+
+	writeJson(w, http.StatusOK, socket.GetStatus())
+}
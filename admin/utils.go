@@ -0,0 +1,27 @@
+package admin
+
+import (
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"net/http"
+)
+
+func writeJson(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("admin: Failed to write response")
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, typ string, err error) {
+	writeJson(w, code, &errortypes.ErrorData{
+		Error:   typ,
+		Message: err.Error(),
+	})
+}
@@ -0,0 +1,191 @@
+package authority
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-hsm/config"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/mgo.v2/bson"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	approvals     = map[string]*Approval{}
+	approvalsLock = sync.Mutex{}
+)
+
+type Approval struct {
+	Id              string            `json:"id"`
+	Serial          string            `json:"serial"`
+	KeyId           string            `json:"key_id"`
+	CertType        string            `json:"cert_type"`
+	Principals      []string          `json:"principals"`
+	Fingerprint     string            `json:"fingerprint"`
+	CriticalOptions map[string]string `json:"critical_options"`
+	Extensions      map[string]string `json:"extensions"`
+	ValidAfter      uint64            `json:"valid_after"`
+	ValidBefore     uint64            `json:"valid_before"`
+	Timestamp       int64             `json:"timestamp"`
+	Expires         int64             `json:"expires"`
+	result          chan bool
+}
+
+// Certificates without principals are valid for every principal and match
+// any approval pattern
+func requiresApproval(cert *ssh.Certificate) bool {
+	if len(cert.ValidPrincipals) == 0 &&
+		len(config.Config.ApprovalPrincipals) > 0 {
+
+		return true
+	}
+
+	for _, pattern := range config.Config.ApprovalPrincipals {
+		for _, principal := range cert.ValidPrincipals {
+			if match, _ := path.Match(pattern, principal); match {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func waitApproval(serial string, cert *ssh.Certificate) (err error) {
+	timeout := config.Config.ApprovalTimeout
+	if timeout == 0 {
+		timeout = config.DefaultApprovalTimeout
+	}
+
+	now := time.Now()
+
+	certType := "user"
+	if cert.CertType == ssh.HostCert {
+		certType = "host"
+	}
+
+	approval := &Approval{
+		Id:              bson.NewObjectId().Hex(),
+		Serial:          serial,
+		KeyId:           cert.KeyId,
+		CertType:        certType,
+		Principals:      cert.ValidPrincipals,
+		Fingerprint:     ssh.FingerprintSHA256(cert.Key),
+		CriticalOptions: cert.CriticalOptions,
+		Extensions:      cert.Extensions,
+		ValidAfter:      cert.ValidAfter,
+		ValidBefore:     cert.ValidBefore,
+		Timestamp:       now.Unix(),
+		Expires:         now.Add(time.Duration(timeout) * time.Second).Unix(),
+		result:          make(chan bool, 1),
+	}
+
+	approvalsLock.Lock()
+	approvals[approval.Id] = approval
+	approvalsLock.Unlock()
+
+	defer func() {
+		approvalsLock.Lock()
+		delete(approvals, approval.Id)
+		approvalsLock.Unlock()
+	}()
+
+	logrus.WithFields(logrus.Fields{
+		"approval_id": approval.Id,
+		"key_id":      approval.KeyId,
+		"principals":  approval.Principals,
+		"fingerprint": approval.Fingerprint,
+	}).Warn("authority: Certificate request pending approval")
+
+	timer := time.NewTimer(time.Duration(timeout) * time.Second)
+	defer timer.Stop()
+
+	select {
+	case approved := <-approval.result:
+		if !approved {
+			logrus.WithFields(logrus.Fields{
+				"approval_id": approval.Id,
+				"key_id":      approval.KeyId,
+			}).Warn("authority: Certificate request denied by operator")
+
+			err = &errortypes.PolicyError{
+				errors.New("authority: Certificate request denied " +
+					"by operator"),
+			}
+			return
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"approval_id": approval.Id,
+			"key_id":      approval.KeyId,
+		}).Info("authority: Certificate request approved by operator")
+	case <-timer.C:
+		logrus.WithFields(logrus.Fields{
+			"approval_id": approval.Id,
+			"key_id":      approval.KeyId,
+		}).Warn("authority: Certificate request approval timed out")
+
+		err = &errortypes.PolicyError{
+			errors.New("authority: Certificate request approval " +
+				"timed out"),
+		}
+		return
+	}
+
+	return
+}
+
+func GetApprovals() (pending []*Approval) {
+	pending = []*Approval{}
+
+	approvalsLock.Lock()
+	for _, approval := range approvals {
+		pending = append(pending, approval)
+	}
+	approvalsLock.Unlock()
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Timestamp < pending[j].Timestamp
+	})
+
+	return
+}
+
+func resolveApproval(id string, approved bool) (err error) {
+	approvalsLock.Lock()
+	approval := approvals[id]
+	delete(approvals, id)
+	approvalsLock.Unlock()
+
+	if approval == nil {
+		err = &errortypes.NotFoundError{
+			errors.New("authority: Pending approval not found"),
+		}
+		return
+	}
+
+	approval.result <- approved
+
+	return
+}
+
+func Approve(id string) (err error) {
+	err = resolveApproval(id, true)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func Deny(id string) (err error) {
+	err = resolveApproval(id, false)
+	if err != nil {
+		return
+	}
+
+	return
+}
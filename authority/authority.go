@@ -1,5 +1,9 @@
 package authority
 
+import (
+	"encoding/json"
+)
+
 type SshRequest struct {
 	Serial      string `json:"serial"`
 	Certificate []byte `json:"certificate"`
@@ -7,18 +11,171 @@ type SshRequest struct {
 
 type SshResponse struct {
 	Certificate []byte `json:"certificate"`
+	Error       string `json:"error,omitempty"`
+	ErrorMsg    string `json:"error_msg,omitempty"`
+}
+
+type LimiterStatus struct {
+	GlobalTokens        float64  `json:"global_tokens"`
+	KeyIds              int      `json:"key_ids"`
+	Principals          int      `json:"principals"`
+	LimitedKeyIds       []string `json:"limited_key_ids"`
+	LimitedPrincipals   []string `json:"limited_principals"`
+	GlobalRejected      uint64   `json:"global_rejected"`
+	KeyIdRejected       uint64   `json:"key_id_rejected"`
+	PrincipalRejected   uint64   `json:"principal_rejected"`
+	LastRejected        int64    `json:"last_rejected"`
+	LastRejectedScope   string   `json:"last_rejected_scope"`
+	LastRejectedSubject string   `json:"last_rejected_subject"`
+}
+
+type ResponseKeyStatus struct {
+	Slot                    string `json:"slot"`
+	Algorithm               string `json:"algorithm"`
+	PublicKey               string `json:"public_key"`
+	Attestation             string `json:"attestation"`
+	AttestationIntermediate string `json:"attestation_intermediate"`
+}
+
+type SshBatchRequest struct {
+	Requests []*SshRequest `json:"requests"`
+}
+
+type SshBatchResponse struct {
+	Results []*SshResponse `json:"results"`
+}
+
+type SignResult struct {
+	Certificate []byte
+	Error       error
+}
+
+type JwtRequest struct {
+	Serial string          `json:"serial"`
+	Key    string          `json:"key"`
+	Claims json.RawMessage `json:"claims"`
+}
+
+type JwtResponse struct {
+	Token    string `json:"token"`
+	Error    string `json:"error,omitempty"`
+	ErrorMsg string `json:"error_msg,omitempty"`
+}
+
+type Jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type Jwks struct {
+	Keys []*Jwk `json:"keys"`
+}
+
+type SlotStatus struct {
+	Slot        string `json:"slot"`
+	Algorithm   string `json:"algorithm"`
+	PinPolicy   string `json:"pin_policy"`
+	TouchPolicy string `json:"touch_policy"`
+}
+
+type DeviceStatus struct {
+	Serial     string        `json:"serial"`
+	Firmware   string        `json:"firmware"`
+	PinRetries int           `json:"pin_retries"`
+	Slots      []*SlotStatus `json:"slots"`
+}
+
+type AgentStatus struct {
+	Version string `json:"version"`
+	Uptime  int64  `json:"uptime"`
+}
+
+type ConnectionStatus struct {
+	Hosts            int    `json:"hosts"`
+	Connected        int    `json:"connected"`
+	Connects         uint64 `json:"connects"`
+	Latency          int64  `json:"latency"`
+	HeartbeatLatency int64  `json:"heartbeat_latency"`
+	MissedHeartbeats int    `json:"missed_heartbeats"`
+}
+
+type SignStatus struct {
+	SshSigned     uint64 `json:"ssh_signed"`
+	SshFailed     uint64 `json:"ssh_failed"`
+	JwtSigned     uint64 `json:"jwt_signed"`
+	JwtFailed     uint64 `json:"jwt_failed"`
+	LastError     string `json:"last_error"`
+	LastErrorTime int64  `json:"last_error_time"`
 }
 
 type HsmStatus struct {
-	Status       string `json:"status"`
-	SshPublicKey string `json:"ssh_public_key"`
+	Status       string             `json:"status"`
+	SshPublicKey string             `json:"ssh_public_key"`
+	Device       *DeviceStatus      `json:"device"`
+	Agent        *AgentStatus       `json:"agent"`
+	Connections  *ConnectionStatus  `json:"connections"`
+	Signing      *SignStatus        `json:"signing"`
+	RateLimits   *LimiterStatus     `json:"rate_limits"`
+	ResponseKey  *ResponseKeyStatus `json:"response_key"`
+	Jwks         *Jwks              `json:"jwks"`
+}
+
+type KeyCapability struct {
+	Type      string `json:"type"`
+	Alias     string `json:"alias"`
+	Slot      string `json:"slot"`
+	Algorithm string `json:"algorithm"`
+}
+
+type HsmCapabilities struct {
+	AgentVersion    string           `json:"agent_version"`
+	ProtocolVersion int              `json:"protocol_version"`
+	PayloadVersions []int            `json:"payload_versions"`
+	MessageTypes    []string         `json:"message_types"`
+	Keys            []*KeyCapability `json:"keys"`
+	Firmware        string           `json:"firmware"`
+}
+
+type Heartbeat struct {
+	Timestamp int64 `json:"timestamp"`
+}
+
+type TouchPending struct {
+	Serial  string `json:"serial"`
+	Timeout int    `json:"timeout"`
+}
+
+type HsmError struct {
+	Type     string `json:"type"`
+	Error    string `json:"error"`
+	ErrorMsg string `json:"error_msg"`
+}
+
+type HsmAlert struct {
+	Type      string `json:"type"`
+	Message   string `json:"message"`
+	Timestamp int64  `json:"timestamp"`
 }
 
 type HsmPayload struct {
 	Id        string `json:"id"`
+	Version   int    `json:"version,omitempty"`
 	Token     string `json:"token"`
-	Signature string `json:"signature"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+	Deadline  int64  `json:"deadline,omitempty"`
+	Signature string `json:"signature,omitempty"`
 	Iv        []byte `json:"iv"`
 	Type      string `json:"type"`
 	Data      []byte `json:"data"`
+
+	HsmSignature          []byte `json:"hsm_signature,omitempty"`
+	HsmSignatureAlgorithm string `json:"hsm_signature_algorithm,omitempty"`
 }
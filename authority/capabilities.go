@@ -0,0 +1,91 @@
+package authority
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/pritunl/pritunl-hsm/config"
+	"github.com/pritunl/pritunl-hsm/constants"
+	"github.com/pritunl/pritunl-hsm/yubikey"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+)
+
+func getKeyCapabilities(serial string) (keys []*KeyCapability) {
+	keys = []*KeyCapability{}
+	keyConf := config.Config.GetKey(serial)
+
+	var sshKey ssh.PublicKey
+	if pubKey := yubikey.GetPublicKey(serial); pubKey != "" {
+		sshKey, _, _, _, _ = ssh.ParseAuthorizedKey([]byte(pubKey))
+	}
+
+	if sshKey != nil {
+		algo := sshKey.Type()
+		if algo == ssh.KeyAlgoRSA {
+			algo = keyConf.SshAlgorithm
+			if algo == "" {
+				algo = config.DefaultSshAlgorithm
+			}
+		}
+
+		keys = append(keys, &KeyCapability{
+			Type:      "ssh",
+			Alias:     "ssh_ca",
+			Slot:      "9a",
+			Algorithm: algo,
+		})
+	}
+
+	responseKey, err := getResponseKeyStatus(serial)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("authority: Failed to load response key status")
+	} else if responseKey != nil {
+		keys = append(keys, &KeyCapability{
+			Type:      "response",
+			Alias:     "response",
+			Slot:      keyConf.ResponseSlot,
+			Algorithm: responseKey.Algorithm,
+		})
+	}
+
+	aliases := []string{}
+	for alias := range keyConf.JwtKeys {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+
+	for _, alias := range aliases {
+		jwtKey := keyConf.JwtKeys[alias]
+		keys = append(keys, &KeyCapability{
+			Type:      "jwt",
+			Alias:     alias,
+			Slot:      jwtKey.Slot,
+			Algorithm: jwtKey.Algorithm,
+		})
+	}
+
+	return
+}
+
+func GetCapabilitiesPayload(version int, token, secret, serial string,
+	messageTypes []string) (payload *HsmPayload, err error) {
+
+	data := &HsmCapabilities{
+		AgentVersion:    constants.Version,
+		ProtocolVersion: PayloadVersion,
+		PayloadVersions: PayloadVersions,
+		MessageTypes:    messageTypes,
+		Keys:            getKeyCapabilities(serial),
+		Firmware:        yubikey.GetFirmware(serial),
+	}
+
+	payload, err = MarshalPayload(version,
+		bson.NewObjectId().Hex(), token, secret, "capabilities", data)
+	if err != nil {
+		return
+	}
+
+	return
+}
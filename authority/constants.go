@@ -0,0 +1,13 @@
+package authority
+
+const (
+	PayloadVersion1 = 1
+	PayloadVersion2 = 2
+	PayloadVersion  = PayloadVersion2
+
+	payloadKeyInfo = "pritunl-hsm-payload-v2"
+)
+
+var (
+	PayloadVersions = []int{PayloadVersion1, PayloadVersion2}
+)
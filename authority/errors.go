@@ -0,0 +1,71 @@
+package authority
+
+import (
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"github.com/pritunl/pritunl-hsm/ykpiv"
+)
+
+// Maps an error to the class and message reported to Zero. Only messages
+// from errors created by this service are forwarded, wrapped errors from
+// the device and libraries are replaced with a generic message.
+func GetErrorClass(err error) (class, message string) {
+	switch typedErr := err.(type) {
+	case *errortypes.AuthenticationError:
+		class = "authentication_error"
+		message = typedErr.GetMessage()
+	case *errortypes.ParseError:
+		class = "parse_error"
+		message = typedErr.GetMessage()
+	case *errortypes.NotFoundError:
+		class = "not_found"
+		message = typedErr.GetMessage()
+	case *errortypes.PolicyError:
+		class = "policy_denied"
+		message = typedErr.GetMessage()
+	case *errortypes.RateLimitError:
+		class = "rate_limited"
+		message = typedErr.GetMessage()
+	case *errortypes.TimeoutError:
+		class = "touch_timeout"
+		message = typedErr.GetMessage()
+	case *errortypes.DeviceError:
+		class = "device_error"
+		message = typedErr.GetMessage()
+	case *errortypes.UnavailableError:
+		class = "unavailable"
+		message = typedErr.GetMessage()
+	case *errortypes.DuplicateError:
+		class = "duplicate_request"
+		message = typedErr.GetMessage()
+	case *errortypes.ExpiredError:
+		class = "expired"
+		message = typedErr.GetMessage()
+	case ykpiv.Error:
+		class = "device_error"
+		message = "authority: Device operation failed, " + typedErr.Message
+	default:
+		class = "unknown_error"
+		message = "authority: Unknown error"
+	}
+
+	return
+}
+
+func GetErrorPayload(version int, id, token, secret, typ string,
+	err error) (payload *HsmPayload, e error) {
+
+	class, message := GetErrorClass(err)
+
+	data := &HsmError{
+		Type:     typ,
+		Error:    class,
+		ErrorMsg: message,
+	}
+
+	payload, e = MarshalPayload(version, id, token, secret, "error", data)
+	if e != nil {
+		return
+	}
+
+	return
+}
@@ -0,0 +1,439 @@
+package authority
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-hsm/config"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"github.com/pritunl/pritunl-hsm/yubikey"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	jwks     = map[string]*Jwk{}
+	jwksLock = sync.Mutex{}
+)
+
+type ecdsaSignature struct {
+	R *big.Int
+	S *big.Int
+}
+
+func getJwtHash(algo string, data []byte) (
+	hash crypto.Hash, digest []byte) {
+
+	switch algo {
+	case "ES384":
+		sum := sha512.Sum384(data)
+		hash = crypto.SHA384
+		digest = sum[:]
+	default:
+		sum := sha256.Sum256(data)
+		hash = crypto.SHA256
+		digest = sum[:]
+	}
+
+	return
+}
+
+func checkJwtKey(algo string, pubKey crypto.PublicKey) (err error) {
+	valid := false
+
+	switch key := pubKey.(type) {
+	case *rsa.PublicKey:
+		valid = algo == "RS256" || algo == "PS256"
+	case *ecdsa.PublicKey:
+		switch key.Params().BitSize {
+		case 256:
+			valid = algo == "ES256"
+		case 384:
+			valid = algo == "ES384"
+		}
+	}
+
+	if !valid {
+		err = &errortypes.ParseError{
+			errors.Newf("authority: JWT algorithm '%s' does not "+
+				"match key", algo),
+		}
+		return
+	}
+
+	return
+}
+
+func checkJwtClaims(keyConf *config.JwtKeyConfig,
+	claims map[string]interface{}) (err error) {
+
+	if len(keyConf.Issuers) > 0 {
+		iss, _ := claims["iss"].(string)
+		if !contains(keyConf.Issuers, iss) {
+			err = &errortypes.PolicyError{
+				errors.New("authority: JWT issuer not allowed"),
+			}
+			return
+		}
+	}
+
+	if len(keyConf.Audiences) > 0 {
+		auds := []string{}
+		switch aud := claims["aud"].(type) {
+		case string:
+			auds = append(auds, aud)
+		case []interface{}:
+			for _, a := range aud {
+				audStr, ok := a.(string)
+				if !ok {
+					err = &errortypes.PolicyError{
+						errors.New("authority: JWT audience invalid"),
+					}
+					return
+				}
+				auds = append(auds, audStr)
+			}
+		}
+
+		if len(auds) == 0 {
+			err = &errortypes.PolicyError{
+				errors.New("authority: JWT audience required"),
+			}
+			return
+		}
+
+		for _, aud := range auds {
+			if !contains(keyConf.Audiences, aud) {
+				err = &errortypes.PolicyError{
+					errors.New("authority: JWT audience not allowed"),
+				}
+				return
+			}
+		}
+	}
+
+	maxExpire := keyConf.MaxExpire
+	if maxExpire == 0 {
+		maxExpire = config.DefaultJwtMaxExpire
+	}
+
+	expNum, ok := claims["exp"].(json.Number)
+	if !ok {
+		err = &errortypes.PolicyError{
+			errors.New("authority: JWT expiration required"),
+		}
+		return
+	}
+
+	exp, e := expNum.Int64()
+	if e != nil {
+		err = &errortypes.PolicyError{
+			errors.New("authority: JWT expiration invalid"),
+		}
+		return
+	}
+
+	now := time.Now()
+	if exp <= now.Unix() {
+		err = &errortypes.PolicyError{
+			errors.New("authority: JWT already expired"),
+		}
+		return
+	}
+
+	if exp > now.Add(time.Duration(maxExpire)*time.Second).Unix() {
+		err = &errortypes.PolicyError{
+			errors.New("authority: JWT expiration exceeds policy"),
+		}
+		return
+	}
+
+	return
+}
+
+func contains(list []string, val string) bool {
+	for _, item := range list {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
+
+func getJwtKeyConf(serial, alias string) (
+	keyConf *config.JwtKeyConfig, err error) {
+
+	keyConf = config.Config.GetKey(serial).JwtKeys[alias]
+	if keyConf == nil {
+		err = &errortypes.NotFoundError{
+			errors.Newf("authority: Unknown JWT key '%s'", alias),
+		}
+		return
+	}
+
+	return
+}
+
+func SignJwt(hsmSerial string, jwtReq *JwtRequest, deadline time.Time,
+	touchPending func(timeout time.Duration)) (token string, err error) {
+
+	defer func() {
+		signStats.record("jwt", err)
+	}()
+
+	if jwtReq.Serial != hsmSerial {
+		err = &errortypes.AuthenticationError{
+			errors.New("authority: HSM serial mismatch"),
+		}
+		return
+	}
+
+	keyConf, err := getJwtKeyConf(hsmSerial, jwtReq.Key)
+	if err != nil {
+		return
+	}
+
+	slotId, err := yubikey.ParseSlot(keyConf.Slot)
+	if err != nil {
+		return
+	}
+
+	claims := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(jwtReq.Claims))
+	decoder.UseNumber()
+	err = decoder.Decode(&claims)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "authority: Failed to parse JWT claims"),
+		}
+		return
+	}
+
+	err = checkJwtClaims(keyConf, claims)
+	if err != nil {
+		return
+	}
+
+	header, err := json.Marshal(map[string]string{
+		"alg": keyConf.Algorithm,
+		"typ": "JWT",
+		"kid": jwtReq.Key,
+	})
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "authority: Failed to marshal JWT header"),
+		}
+		return
+	}
+
+	claimsData, err := json.Marshal(claims)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "authority: Failed to marshal JWT claims"),
+		}
+		return
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(claimsData)
+
+	hash, digest := getJwtHash(keyConf.Algorithm, []byte(signingInput))
+
+	var opts crypto.SignerOpts = hash
+	if keyConf.Algorithm == "PS256" {
+		opts = &rsa.PSSOptions{
+			SaltLength: rsa.PSSSaltLengthEqualsHash,
+			Hash:       hash,
+		}
+	}
+
+	yubi := yubikey.GetKey(hsmSerial)
+	if yubi == nil {
+		err = &errortypes.NotFoundError{
+			errors.New("authority: Failed to find hsm"),
+		}
+		return
+	}
+
+	err = checkDeadline(deadline)
+	if err != nil {
+		return
+	}
+
+	yubikey.LockKey(hsmSerial)
+
+	err = checkDeadline(deadline)
+	if err != nil {
+		yubikey.UnlockKey(hsmSerial)
+		return
+	}
+
+	slot, err := yubi.Slot(slotId)
+	if err != nil {
+		yubikey.UnlockKey(hsmSerial)
+		return
+	}
+
+	err = checkJwtKey(keyConf.Algorithm, slot.Public())
+	if err != nil {
+		yubikey.UnlockKey(hsmSerial)
+		return
+	}
+
+	notifyTouch(hsmSerial, yubi, slotId, touchPending)
+
+	err = checkDeadline(deadline)
+	if err != nil {
+		yubikey.UnlockKey(hsmSerial)
+		return
+	}
+
+	var sig []byte
+	err = runLocked(hsmSerial, getTouchTimeout(hsmSerial),
+		func() (e error) {
+			sig, e = slot.Sign(rand.Reader, digest, opts)
+			if e != nil {
+				e = &errortypes.DeviceError{
+					errors.Wrap(e, "authority: Failed to sign JWT"),
+				}
+			}
+			return
+		})
+	if err != nil {
+		return
+	}
+
+	if ecPub, ok := slot.Public().(*ecdsa.PublicKey); ok {
+		sig, err = convertEcdsaSignature(ecPub, sig)
+		if err != nil {
+			return
+		}
+	}
+
+	token = signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+
+	return
+}
+
+// JWS requires ECDSA signatures as fixed width R and S rather than DER
+func convertEcdsaSignature(pubKey *ecdsa.PublicKey, der []byte) (
+	sig []byte, err error) {
+
+	ecSig := &ecdsaSignature{}
+	_, err = asn1.Unmarshal(der, ecSig)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "authority: Failed to parse ECDSA signature"),
+		}
+		return
+	}
+
+	size := (pubKey.Params().BitSize + 7) / 8
+	sig = make([]byte, 2*size)
+	ecSig.R.FillBytes(sig[:size])
+	ecSig.S.FillBytes(sig[size:])
+
+	return
+}
+
+func getJwk(serial, alias string, keyConf *config.JwtKeyConfig) (
+	jwk *Jwk, err error) {
+
+	cacheKey := serial + "&" + alias + "&" + keyConf.Slot
+
+	jwksLock.Lock()
+	jwk = jwks[cacheKey]
+	jwksLock.Unlock()
+	if jwk != nil {
+		return
+	}
+
+	slotId, err := yubikey.ParseSlot(keyConf.Slot)
+	if err != nil {
+		return
+	}
+
+	yubi := yubikey.GetKey(serial)
+	if yubi == nil {
+		err = &errortypes.NotFoundError{
+			errors.New("authority: Failed to find hsm"),
+		}
+		return
+	}
+
+	yubikey.LockKey(serial)
+	slot, err := yubi.Slot(slotId)
+	yubikey.UnlockKey(serial)
+	if err != nil {
+		return
+	}
+
+	err = checkJwtKey(keyConf.Algorithm, slot.Public())
+	if err != nil {
+		return
+	}
+
+	jwk = &Jwk{
+		Kid: alias,
+		Use: "sig",
+		Alg: keyConf.Algorithm,
+	}
+
+	switch key := slot.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(
+			big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (key.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = key.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(
+			key.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(
+			key.Y.FillBytes(make([]byte, size)))
+	}
+
+	jwksLock.Lock()
+	jwks[cacheKey] = jwk
+	jwksLock.Unlock()
+
+	return
+}
+
+func getJwks(serial string) (keySet *Jwks, err error) {
+	keySet = &Jwks{
+		Keys: []*Jwk{},
+	}
+
+	jwtKeys := config.Config.GetKey(serial).JwtKeys
+
+	aliases := []string{}
+	for alias := range jwtKeys {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+
+	for _, alias := range aliases {
+		jwk, e := getJwk(serial, alias, jwtKeys[alias])
+		if e != nil {
+			err = e
+			continue
+		}
+
+		keySet.Keys = append(keySet.Keys, jwk)
+	}
+
+	return
+}
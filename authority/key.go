@@ -0,0 +1,201 @@
+package authority
+
+import (
+	"crypto/rsa"
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-hsm/config"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"github.com/pritunl/pritunl-hsm/ykpiv"
+	"github.com/pritunl/pritunl-hsm/yubikey"
+	"golang.org/x/crypto/ssh"
+	"sync"
+)
+
+var (
+	deviceKeys       = map[string]map[string]bool{}
+	deviceKeysConfig *config.ConfigData
+	deviceKeysLock   = sync.Mutex{}
+)
+
+// Fingerprints of the CA, response and JWT keys, slot keys can not change
+// while the service is running and are only read from the device once. The
+// response and JWT slots are set in the config so the cache is cleared
+// when the config is reloaded.
+func getDeviceKeys(serial string) (keys map[string]bool, err error) {
+	conf := config.Config
+
+	deviceKeysLock.Lock()
+	if deviceKeysConfig != conf {
+		deviceKeys = map[string]map[string]bool{}
+		deviceKeysConfig = conf
+	}
+	keys = deviceKeys[serial]
+	deviceKeysLock.Unlock()
+	if keys != nil {
+		return
+	}
+
+	keys = map[string]bool{}
+
+	for _, pubKey := range yubikey.GetSshPublicKeys() {
+		keys[ssh.FingerprintSHA256(pubKey)] = true
+	}
+
+	keyConf := conf.GetKey(serial)
+
+	slotIds := []ykpiv.SlotId{}
+	slotNames := []string{}
+	if keyConf.ResponseSlot != "" {
+		slotNames = append(slotNames, keyConf.ResponseSlot)
+	}
+	for _, jwtKey := range keyConf.JwtKeys {
+		slotNames = append(slotNames, jwtKey.Slot)
+	}
+
+	for _, slotName := range slotNames {
+		slotId, e := yubikey.ParseSlot(slotName)
+		if e != nil {
+			err = e
+			return
+		}
+		slotIds = append(slotIds, slotId)
+	}
+
+	if len(slotIds) > 0 {
+		yubi := yubikey.GetKey(serial)
+		if yubi == nil {
+			err = &errortypes.NotFoundError{
+				errors.New("authority: Failed to find hsm"),
+			}
+			return
+		}
+
+		slots := []*ykpiv.Slot{}
+
+		yubikey.LockKey(serial)
+		for _, slotId := range slotIds {
+			slot, e := yubi.Slot(slotId)
+			if e != nil {
+				err = e
+				break
+			}
+			slots = append(slots, slot)
+		}
+		yubikey.UnlockKey(serial)
+
+		if err != nil {
+			return
+		}
+
+		for _, slot := range slots {
+			pubKey, e := ssh.NewPublicKey(slot.Public())
+			if e != nil {
+				err = &errortypes.ParseError{
+					errors.Wrap(e, "authority: Failed to parse slot key"),
+				}
+				return
+			}
+
+			keys[ssh.FingerprintSHA256(pubKey)] = true
+		}
+	}
+
+	deviceKeysLock.Lock()
+	if deviceKeysConfig == conf {
+		deviceKeys[serial] = keys
+	}
+	deviceKeysLock.Unlock()
+
+	return
+}
+
+func checkSubjectKey(hsmSerial string, cert *ssh.Certificate) (err error) {
+	if cert.CertType != ssh.UserCert && cert.CertType != ssh.HostCert {
+		err = &errortypes.PolicyError{
+			errors.New("authority: Certificate type not allowed"),
+		}
+		return
+	}
+
+	if len(cert.ValidPrincipals) == 0 && !config.Config.AllowEmptyPrincipals {
+		err = &errortypes.PolicyError{
+			errors.New("authority: Certificate principals required"),
+		}
+		return
+	}
+
+	if cert.Key == nil {
+		err = &errortypes.ParseError{
+			errors.New("authority: Certificate public key missing"),
+		}
+		return
+	}
+
+	switch cert.Key.Type() {
+	case ssh.KeyAlgoDSA:
+		err = &errortypes.PolicyError{
+			errors.New("authority: DSA public keys not allowed"),
+		}
+		return
+	case ssh.KeyAlgoRSA:
+		minRsaBits := config.Config.MinRsaBits
+		if minRsaBits == 0 {
+			minRsaBits = config.DefaultMinRsaBits
+		}
+
+		cryptoKey, ok := cert.Key.(ssh.CryptoPublicKey)
+		if !ok {
+			err = &errortypes.ParseError{
+				errors.New("authority: Failed to parse rsa public key"),
+			}
+			return
+		}
+
+		rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey)
+		if !ok {
+			err = &errortypes.ParseError{
+				errors.New("authority: Failed to parse rsa public key"),
+			}
+			return
+		}
+
+		if rsaKey.N.BitLen() < minRsaBits {
+			err = &errortypes.PolicyError{
+				errors.Newf("authority: RSA public key below %d bits",
+					minRsaBits),
+			}
+			return
+		}
+	case ssh.KeyAlgoSKECDSA256, ssh.KeyAlgoSKED25519:
+		if config.Config.RequireSkVerify {
+			if _, ok := cert.CriticalOptions["verify-required"]; !ok {
+				err = &errortypes.PolicyError{
+					errors.New("authority: Security key public keys " +
+						"require verify-required"),
+				}
+				return
+			}
+		}
+	}
+
+	hsmKeys, err := getDeviceKeys(hsmSerial)
+	if err != nil {
+		return
+	}
+
+	if hsmKeys[ssh.FingerprintSHA256(cert.Key)] {
+		err = &errortypes.PolicyError{
+			errors.New("authority: Certificate public key matches HSM key"),
+		}
+		return
+	}
+
+	if config.Config.IsDeniedKey(cert.Key) {
+		err = &errortypes.PolicyError{
+			errors.New("authority: Certificate public key denied"),
+		}
+		return
+	}
+
+	return
+}
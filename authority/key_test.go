@@ -0,0 +1,74 @@
+package authority
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"github.com/pritunl/pritunl-hsm/config"
+	"golang.org/x/crypto/ssh"
+	"testing"
+)
+
+const testSerial = "test-serial"
+
+func newTestSshKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error! Failed to generate key: %s", err)
+	}
+
+	pubKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Error! Failed to parse key: %s", err)
+	}
+
+	return pubKey
+}
+
+func newTestSshCert(pubKey ssh.PublicKey) *ssh.Certificate {
+	return &ssh.Certificate{
+		Key:             pubKey,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"root"},
+	}
+}
+
+func TestCheckSubjectKeyHsmKey(t *testing.T) {
+	defer setTestConfig(&config.ConfigData{})()
+
+	hsmKey := newTestSshKey(t)
+	userKey := newTestSshKey(t)
+
+	deviceKeysLock.Lock()
+	deviceKeysConfig = config.Config
+	deviceKeys = map[string]map[string]bool{
+		testSerial: {
+			ssh.FingerprintSHA256(hsmKey): true,
+		},
+	}
+	deviceKeysLock.Unlock()
+
+	err := checkSubjectKey(testSerial, newTestSshCert(hsmKey))
+	if err == nil {
+		t.Fatal("Error! Accepted certificate for HSM key")
+	}
+
+	err = checkSubjectKey(testSerial, newTestSshCert(userKey))
+	if err != nil {
+		t.Fatalf("Error! Rejected certificate for user key: %s", err)
+	}
+
+	// Reloading the config must clear the cached keys
+	config.Config = &config.ConfigData{}
+
+	keys, err := getDeviceKeys(testSerial)
+	if err != nil {
+		t.Fatalf("Error! Failed to get device keys: %s", err)
+	}
+
+	if keys[ssh.FingerprintSHA256(hsmKey)] {
+		t.Fatal("Error! Device keys not cleared on config reload")
+	}
+}
@@ -0,0 +1,275 @@
+package authority
+
+import (
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-hsm/config"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	limiterPruneSize = 4096
+)
+
+var (
+	issueLimiter = &limiter{
+		keyIds:     map[string]*bucket{},
+		principals: map[string]*bucket{},
+	}
+)
+
+type bucket struct {
+	tokens    float64
+	timestamp time.Time
+	lastUsed  time.Time
+}
+
+func (b *bucket) refill(now time.Time, rate, burst float64) {
+	if b.timestamp.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.timestamp).Minutes() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.timestamp = now
+}
+
+// Rates are tokens per minute
+type limit struct {
+	rate  float64
+	burst float64
+}
+
+func getLimit(rate, burst, defRate, defBurst int) (lim limit) {
+	if rate == 0 {
+		rate = defRate
+	}
+	if burst == 0 {
+		burst = defBurst
+	}
+
+	lim = limit{
+		rate:  float64(rate),
+		burst: float64(burst),
+	}
+
+	return
+}
+
+func getLimits() (globalLimit, keyIdLimit, principalLimit limit) {
+	globalLimit = getLimit(
+		config.Config.RateLimitGlobal,
+		config.Config.RateLimitGlobalBurst,
+		config.DefaultRateLimitGlobal,
+		config.DefaultRateLimitGlobalBurst,
+	)
+	keyIdLimit = getLimit(
+		config.Config.RateLimitKeyId,
+		config.Config.RateLimitKeyIdBurst,
+		config.DefaultRateLimitKeyId,
+		config.DefaultRateLimitKeyIdBurst,
+	)
+	principalLimit = getLimit(
+		config.Config.RateLimitPrincipal,
+		config.Config.RateLimitPrincipalBurst,
+		config.DefaultRateLimitPrincipal,
+		config.DefaultRateLimitPrincipalBurst,
+	)
+
+	return
+}
+
+type limiter struct {
+	lock                sync.Mutex
+	global              bucket
+	keyIds              map[string]*bucket
+	principals          map[string]*bucket
+	globalRejected      uint64
+	keyIdRejected       uint64
+	principalRejected   uint64
+	lastRejected        time.Time
+	lastRejectedScope   string
+	lastRejectedSubject string
+}
+
+func (l *limiter) getBucket(buckets map[string]*bucket, key string,
+	now time.Time, lim limit) (b *bucket) {
+
+	b = buckets[key]
+	if b == nil {
+		if len(buckets) >= limiterPruneSize {
+			l.prune(buckets, now, lim)
+			l.evict(buckets)
+		}
+
+		b = &bucket{}
+		buckets[key] = b
+	}
+
+	b.refill(now, lim.rate, lim.burst)
+	b.lastUsed = now
+
+	return
+}
+
+func (l *limiter) prune(buckets map[string]*bucket, now time.Time,
+	lim limit) {
+
+	for key, b := range buckets {
+		b.refill(now, lim.rate, lim.burst)
+		if b.tokens >= lim.burst {
+			delete(buckets, key)
+		}
+	}
+}
+
+// Removes the least recently used buckets when pruning full buckets did not
+// free enough space
+func (l *limiter) evict(buckets map[string]*bucket) {
+	count := len(buckets) - limiterPruneSize + 1
+	if count <= 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(buckets))
+	for key := range buckets {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return buckets[keys[i]].lastUsed.Before(buckets[keys[j]].lastUsed)
+	})
+
+	for _, key := range keys[:count] {
+		delete(buckets, key)
+	}
+}
+
+func (l *limiter) reject(scope, subject string, now time.Time) (
+	err error) {
+
+	switch scope {
+	case "global":
+		l.globalRejected += 1
+	case "key_id":
+		l.keyIdRejected += 1
+	case "principal":
+		l.principalRejected += 1
+	}
+
+	l.lastRejected = now
+	l.lastRejectedScope = scope
+	l.lastRejectedSubject = subject
+
+	err = &errortypes.RateLimitError{
+		errors.Newf("authority: Certificate issue rate limit "+
+			"exceeded for %s '%s'", scope, subject),
+	}
+
+	return
+}
+
+func (l *limiter) Take(keyId string, principals []string) (err error) {
+	err = l.take(keyId, principals, time.Now())
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (l *limiter) take(keyId string, principals []string,
+	now time.Time) (err error) {
+
+	globalLimit, keyIdLimit, principalLimit := getLimits()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.global.refill(now, globalLimit.rate, globalLimit.burst)
+	if l.global.tokens < 1 {
+		err = l.reject("global", "*", now)
+		return
+	}
+
+	keyIdBucket := l.getBucket(l.keyIds, keyId, now, keyIdLimit)
+	if keyIdBucket.tokens < 1 {
+		err = l.reject("key_id", keyId, now)
+		return
+	}
+
+	principalBuckets := []*bucket{}
+	seen := map[string]bool{}
+	for _, principal := range principals {
+		if seen[principal] {
+			continue
+		}
+		seen[principal] = true
+
+		b := l.getBucket(l.principals, principal, now, principalLimit)
+		if b.tokens < 1 {
+			err = l.reject("principal", principal, now)
+			return
+		}
+		principalBuckets = append(principalBuckets, b)
+	}
+
+	l.global.tokens -= 1
+	keyIdBucket.tokens -= 1
+	for _, b := range principalBuckets {
+		b.tokens -= 1
+	}
+
+	return
+}
+
+func (l *limiter) Status() (status *LimiterStatus) {
+	globalLimit, keyIdLimit, principalLimit := getLimits()
+
+	now := time.Now()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.global.refill(now, globalLimit.rate, globalLimit.burst)
+
+	status = &LimiterStatus{
+		GlobalTokens:        l.global.tokens,
+		KeyIds:              len(l.keyIds),
+		Principals:          len(l.principals),
+		LimitedKeyIds:       []string{},
+		LimitedPrincipals:   []string{},
+		GlobalRejected:      l.globalRejected,
+		KeyIdRejected:       l.keyIdRejected,
+		PrincipalRejected:   l.principalRejected,
+		LastRejectedScope:   l.lastRejectedScope,
+		LastRejectedSubject: l.lastRejectedSubject,
+	}
+
+	if !l.lastRejected.IsZero() {
+		status.LastRejected = l.lastRejected.Unix()
+	}
+
+	for keyId, b := range l.keyIds {
+		b.refill(now, keyIdLimit.rate, keyIdLimit.burst)
+		if b.tokens < 1 {
+			status.LimitedKeyIds = append(status.LimitedKeyIds, keyId)
+		}
+	}
+	sort.Strings(status.LimitedKeyIds)
+
+	for principal, b := range l.principals {
+		b.refill(now, principalLimit.rate, principalLimit.burst)
+		if b.tokens < 1 {
+			status.LimitedPrincipals = append(
+				status.LimitedPrincipals, principal)
+		}
+	}
+	sort.Strings(status.LimitedPrincipals)
+
+	return
+}
@@ -0,0 +1,185 @@
+package authority
+
+import (
+	"fmt"
+	"github.com/pritunl/pritunl-hsm/config"
+	"testing"
+	"time"
+)
+
+type limiterStep struct {
+	offset     time.Duration
+	keyId      string
+	principals []string
+	scope      string
+}
+
+func newTestLimiter() *limiter {
+	return &limiter{
+		keyIds:     map[string]*bucket{},
+		principals: map[string]*bucket{},
+	}
+}
+
+func setTestConfig(conf *config.ConfigData) func() {
+	orig := config.Config
+	config.Config = conf
+	return func() {
+		config.Config = orig
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	tests := []struct {
+		name  string
+		conf  *config.ConfigData
+		steps []limiterStep
+	}{
+		{
+			name: "burst",
+			conf: &config.ConfigData{
+				RateLimitKeyId:      1,
+				RateLimitKeyIdBurst: 3,
+			},
+			steps: []limiterStep{
+				{0, "user", nil, ""},
+				{0, "user", nil, ""},
+				{0, "user", nil, ""},
+				{0, "user", nil, "key_id"},
+			},
+		},
+		{
+			name: "refill",
+			conf: &config.ConfigData{
+				RateLimitKeyId:      60,
+				RateLimitKeyIdBurst: 1,
+			},
+			steps: []limiterStep{
+				{0, "user", nil, ""},
+				{0, "user", nil, "key_id"},
+				{500 * time.Millisecond, "user", nil, "key_id"},
+				{time.Second, "user", nil, ""},
+				{time.Second, "user", nil, "key_id"},
+				{time.Minute, "user", nil, ""},
+				{time.Minute, "user", nil, "key_id"},
+			},
+		},
+		{
+			name: "principal_dedupe",
+			conf: &config.ConfigData{
+				RateLimitPrincipal:      1,
+				RateLimitPrincipalBurst: 2,
+			},
+			steps: []limiterStep{
+				{0, "user1", []string{"root", "root", "root"}, ""},
+				{0, "user2", []string{"root"}, ""},
+				{0, "user3", []string{"root"}, "principal"},
+			},
+		},
+		{
+			name: "global_scope",
+			conf: &config.ConfigData{
+				RateLimitGlobal:      1,
+				RateLimitGlobalBurst: 2,
+			},
+			steps: []limiterStep{
+				{0, "user1", []string{"root"}, ""},
+				{0, "user2", []string{"admin"}, ""},
+				{0, "user3", []string{"ubuntu"}, "global"},
+			},
+		},
+		{
+			name: "key_id_scope",
+			conf: &config.ConfigData{
+				RateLimitKeyId:      1,
+				RateLimitKeyIdBurst: 1,
+			},
+			steps: []limiterStep{
+				{0, "user1", []string{"root"}, ""},
+				{0, "user1", []string{"admin"}, "key_id"},
+				{0, "user2", []string{"admin"}, ""},
+			},
+		},
+		{
+			// A rejected request must not take tokens from the other
+			// buckets
+			name: "rejected_no_tokens",
+			conf: &config.ConfigData{
+				RateLimitKeyId:          1,
+				RateLimitKeyIdBurst:     1,
+				RateLimitPrincipal:      1,
+				RateLimitPrincipalBurst: 1,
+			},
+			steps: []limiterStep{
+				{0, "user1", []string{"root"}, ""},
+				{0, "user2", []string{"admin", "root"}, "principal"},
+				{0, "user2", []string{"admin"}, ""},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		restore := setTestConfig(test.conf)
+
+		lim := newTestLimiter()
+		start := time.Now()
+
+		for i, step := range test.steps {
+			err := lim.take(step.keyId, step.principals,
+				start.Add(step.offset))
+
+			if step.scope == "" {
+				if err != nil {
+					t.Fatalf("Error! Test %s step %d rejected: %s",
+						test.name, i, err)
+				}
+				continue
+			}
+
+			if err == nil {
+				t.Fatalf("Error! Test %s step %d not rejected",
+					test.name, i)
+			}
+
+			if lim.lastRejectedScope != step.scope {
+				t.Fatalf("Error! Test %s step %d rejected for %s not %s",
+					test.name, i, lim.lastRejectedScope, step.scope)
+			}
+		}
+
+		restore()
+	}
+}
+
+func TestLimiterEvict(t *testing.T) {
+	defer setTestConfig(&config.ConfigData{
+		RateLimitGlobalBurst: 2 * limiterPruneSize,
+		RateLimitKeyId:       1,
+		RateLimitKeyIdBurst:  1,
+	})()
+
+	lim := newTestLimiter()
+	start := time.Now()
+
+	for i := 0; i < limiterPruneSize+10; i++ {
+		err := lim.take(fmt.Sprintf("user%d", i), nil,
+			start.Add(time.Duration(i)*time.Millisecond))
+		if err != nil {
+			t.Fatalf("Error! Take %d rejected: %s", i, err)
+		}
+
+		if len(lim.keyIds) > limiterPruneSize {
+			t.Fatalf("Error! Key id buckets exceeded %d",
+				limiterPruneSize)
+		}
+	}
+
+	if lim.keyIds["user0"] != nil {
+		t.Fatal("Error! Least recently used bucket not evicted")
+	}
+
+	last := fmt.Sprintf("user%d", limiterPruneSize+9)
+	if lim.keyIds[last] == nil {
+		t.Fatal("Error! Most recently used bucket evicted")
+	}
+}
@@ -0,0 +1,385 @@
+package authority
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-hsm/config"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"github.com/pritunl/pritunl-hsm/utils"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func getPayloadKey(secret string) (key []byte, err error) {
+	key = make([]byte, 32)
+
+	reader := hkdf.New(sha256.New, []byte(secret), nil,
+		[]byte(payloadKeyInfo))
+
+	_, err = io.ReadFull(reader, key)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "authority: Failed to derive payload key"),
+		}
+		return
+	}
+
+	return
+}
+
+func getPayloadAad(payload *HsmPayload) []byte {
+	fields := []string{
+		strconv.Itoa(payload.Version),
+		payload.Id,
+		payload.Token,
+		payload.Type,
+		strconv.FormatInt(payload.Timestamp, 10),
+		payload.Nonce,
+	}
+
+	// Deadline is optional and only authenticated when set to remain
+	// compatible with payloads sent without one
+	if payload.Deadline != 0 {
+		fields = append(fields, strconv.FormatInt(payload.Deadline, 10))
+	}
+
+	return []byte(strings.Join(fields, "&"))
+}
+
+func (p *HsmPayload) GetDeadline() (deadline time.Time) {
+	if p.Deadline != 0 {
+		deadline = time.Unix(p.Deadline, 0)
+	}
+	return
+}
+
+func checkDeadline(deadline time.Time) (err error) {
+	if !deadline.IsZero() && time.Now().After(deadline) {
+		err = &errortypes.ExpiredError{
+			errors.New("authority: Request deadline expired"),
+		}
+		return
+	}
+
+	return
+}
+
+// Returns an error if the payload deadline has passed
+func CheckDeadline(payload *HsmPayload) (err error) {
+	err = checkDeadline(payload.GetDeadline())
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func getPayloadCipher(secret string) (aead cipher.AEAD, err error) {
+	cipKey, err := getPayloadKey(secret)
+	if err != nil {
+		return
+	}
+
+	block, err := aes.NewCipher(cipKey)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "authority: Failed to load cipher"),
+		}
+		return
+	}
+
+	aead, err = cipher.NewGCM(block)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "authority: Failed to load gcm cipher"),
+		}
+		return
+	}
+
+	return
+}
+
+func unmarshalPayloadV1(secret string, payload *HsmPayload) (
+	data []byte, err error) {
+
+	cipData := payload.Data
+	hashFunc := hmac.New(sha512.New, []byte(secret))
+	hashFunc.Write(cipData)
+	rawSignature := hashFunc.Sum(nil)
+	sig := base64.StdEncoding.EncodeToString(rawSignature)
+
+	if subtle.ConstantTimeCompare([]byte(sig),
+		[]byte(payload.Signature)) != 1 {
+
+		err = &errortypes.AuthenticationError{
+			errors.New("authority: Invalid signature"),
+		}
+		return
+	}
+
+	encKeyHash := sha256.New()
+	encKeyHash.Write([]byte(secret))
+	cipKey := encKeyHash.Sum(nil)
+	cipIv := payload.Iv
+
+	if len(cipIv) != aes.BlockSize {
+		err = &errortypes.ParseError{
+			errors.New("authority: Invalid payload iv length"),
+		}
+		return
+	}
+
+	if len(cipData) == 0 || len(cipData)%16 != 0 {
+		err = &errortypes.ParseError{
+			errors.New("authority: Invalid payload data length"),
+		}
+		return
+	}
+
+	block, err := aes.NewCipher(cipKey)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "authority: Failed to load cipher"),
+		}
+		return
+	}
+
+	mode := cipher.NewCBCDecrypter(block, cipIv)
+	mode.CryptBlocks(cipData, cipData)
+	cipData = bytes.TrimRight(cipData, "\x00")
+
+	data = cipData
+
+	return
+}
+
+func unmarshalPayloadV2(secret string, payload *HsmPayload) (
+	data []byte, err error) {
+
+	if payload.Timestamp == 0 {
+		err = &errortypes.ParseError{
+			errors.New("authority: Invalid payload timestamp"),
+		}
+		return
+	}
+
+	aead, err := getPayloadCipher(secret)
+	if err != nil {
+		return
+	}
+
+	if len(payload.Iv) != aead.NonceSize() {
+		err = &errortypes.ParseError{
+			errors.New("authority: Invalid payload nonce length"),
+		}
+		return
+	}
+
+	data, err = aead.Open(nil, payload.Iv, payload.Data,
+		getPayloadAad(payload))
+	if err != nil {
+		err = &errortypes.AuthenticationError{
+			errors.Wrap(err, "authority: Invalid payload authentication"),
+		}
+		return
+	}
+
+	return
+}
+
+// Payloads below the minimum version are rejected, once a connection has
+// negotiated a version older payloads are not accepted on it
+func UnmarshalPayload(token, secret string, minVersion int,
+	payloadJson []byte) (payload *HsmPayload, data []byte, err error) {
+
+	payload = &HsmPayload{}
+	err = json.Unmarshal(payloadJson, payload)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "authority: Failed to unmarshal payload"),
+		}
+		return
+	}
+
+	if payload.Id == "" || payload.Token == "" || payload.Iv == nil ||
+		payload.Data == nil {
+
+		err = &errortypes.ParseError{
+			errors.New("authority: Invalid payload"),
+		}
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token),
+		[]byte(payload.Token)) != 1 {
+
+		err = &errortypes.AuthenticationError{
+			errors.New("authority: Invalid token"),
+		}
+		return
+	}
+
+	if payload.Version == 0 {
+		payload.Version = PayloadVersion1
+	}
+
+	if config.Config.MinPayloadVersion > minVersion {
+		minVersion = config.Config.MinPayloadVersion
+	}
+	if minVersion == 0 {
+		minVersion = PayloadVersion1
+	}
+
+	if payload.Version < minVersion {
+		err = &errortypes.AuthenticationError{
+			errors.Newf("authority: Payload version %d below minimum",
+				payload.Version),
+		}
+		return
+	}
+
+	// Version 1 payloads have no authenticated timestamp and can only be
+	// protected from replay for the life of the process
+	if payload.Version == PayloadVersion1 && !config.Config.AllowPayloadV1 {
+		err = &errortypes.AuthenticationError{
+			errors.New("authority: Payload version 1 not allowed"),
+		}
+		return
+	}
+
+	switch payload.Version {
+	case PayloadVersion1:
+		data, err = unmarshalPayloadV1(secret, payload)
+	case PayloadVersion2:
+		data, err = unmarshalPayloadV2(secret, payload)
+	default:
+		err = &errortypes.ParseError{
+			errors.Newf("authority: Unsupported payload version %d",
+				payload.Version),
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	err = payloadCache.Check(payload)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func marshalPayloadV1(secret string, payload *HsmPayload,
+	cipData []byte) (err error) {
+
+	pad := 16 - len(cipData)%16
+	for i := 0; i < pad; i++ {
+		cipData = append(cipData, 0)
+	}
+
+	encKeyHash := sha256.New()
+	encKeyHash.Write([]byte(secret))
+	cipKey := encKeyHash.Sum(nil)
+
+	cipIv, err := utils.RandBytes(aes.BlockSize)
+	if err != nil {
+		return
+	}
+
+	block, err := aes.NewCipher(cipKey)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "authority: Failed to load cipher"),
+		}
+		return
+	}
+
+	mode := cipher.NewCBCEncrypter(block, cipIv)
+	mode.CryptBlocks(cipData, cipData)
+
+	hashFunc := hmac.New(sha512.New, []byte(secret))
+	hashFunc.Write(cipData)
+	rawSignature := hashFunc.Sum(nil)
+	sig := base64.StdEncoding.EncodeToString(rawSignature)
+
+	payload.Iv = cipIv
+	payload.Signature = sig
+	payload.Data = cipData
+
+	return
+}
+
+func marshalPayloadV2(secret string, payload *HsmPayload,
+	cipData []byte) (err error) {
+
+	aead, err := getPayloadCipher(secret)
+	if err != nil {
+		return
+	}
+
+	cipNonce, err := utils.RandBytes(aead.NonceSize())
+	if err != nil {
+		return
+	}
+
+	nonce, err := utils.RandStr(32)
+	if err != nil {
+		return
+	}
+
+	payload.Timestamp = time.Now().Unix()
+	payload.Nonce = nonce
+	payload.Iv = cipNonce
+	payload.Data = aead.Seal(nil, cipNonce, cipData, getPayloadAad(payload))
+
+	return
+}
+
+func MarshalPayload(version int, id, token, secret, typ string,
+	data interface{}) (payload *HsmPayload, err error) {
+
+	cipData, err := json.Marshal(data)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "authority: Failed to marshal payload"),
+		}
+		return
+	}
+
+	payload = &HsmPayload{
+		Id:    id,
+		Token: token,
+		Type:  typ,
+	}
+
+	switch version {
+	case 0, PayloadVersion1:
+		err = marshalPayloadV1(secret, payload, cipData)
+	case PayloadVersion2:
+		payload.Version = PayloadVersion2
+		err = marshalPayloadV2(secret, payload, cipData)
+	default:
+		err = &errortypes.ParseError{
+			errors.Newf("authority: Unsupported payload version %d",
+				version),
+		}
+	}
+	if err != nil {
+		payload = nil
+		return
+	}
+
+	return
+}
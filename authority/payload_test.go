@@ -0,0 +1,241 @@
+package authority
+
+import (
+	"encoding/json"
+	"github.com/pritunl/pritunl-hsm/config"
+	"testing"
+	"time"
+)
+
+const (
+	testToken  = "test-token"
+	testSecret = "test-secret"
+)
+
+type testData struct {
+	Value string `json:"value"`
+}
+
+func marshalTest(t *testing.T, payload *HsmPayload) []byte {
+	t.Helper()
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("Error! Failed to marshal payload: %s", err)
+	}
+
+	return raw
+}
+
+func allowV1() func() {
+	config.Config.AllowPayloadV1 = true
+	return func() {
+		config.Config.AllowPayloadV1 = false
+	}
+}
+
+func sealTest(t *testing.T, id string, deadline int64) *HsmPayload {
+	t.Helper()
+
+	payload := &HsmPayload{
+		Id:       id,
+		Token:    testToken,
+		Type:     "ssh_certificate",
+		Version:  PayloadVersion2,
+		Deadline: deadline,
+	}
+
+	data, _ := json.Marshal(&testData{Value: "data"})
+
+	err := marshalPayloadV2(testSecret, payload, data)
+	if err != nil {
+		t.Fatalf("Error! Failed to seal payload: %s", err)
+	}
+
+	return payload
+}
+
+func TestPayloadRoundTrip(t *testing.T) {
+	defer allowV1()()
+
+	for _, version := range PayloadVersions {
+		payload, err := MarshalPayload(version, "round-trip", testToken,
+			testSecret, "ssh_certificate", &testData{Value: "data"})
+		if err != nil {
+			t.Fatalf("Error! Failed to marshal v%d: %s", version, err)
+		}
+
+		result, data, err := UnmarshalPayload(testToken, testSecret, 0,
+			marshalTest(t, payload))
+		if err != nil {
+			t.Fatalf("Error! Failed to unmarshal v%d: %s", version, err)
+		}
+
+		if result.Version != version || result.Id != "round-trip" ||
+			result.Type != "ssh_certificate" {
+
+			t.Fatalf("Error! Payload v%d header mismatch", version)
+		}
+
+		resultData := &testData{}
+		err = json.Unmarshal(data, resultData)
+		if err != nil || resultData.Value != "data" {
+			t.Fatalf("Error! Payload v%d data mismatch", version)
+		}
+	}
+}
+
+func TestPayloadRoundTripDeadline(t *testing.T) {
+	deadline := time.Now().Add(time.Minute).Unix()
+	payload := sealTest(t, "deadline", deadline)
+
+	result, _, err := UnmarshalPayload(testToken, testSecret, 0,
+		marshalTest(t, payload))
+	if err != nil {
+		t.Fatalf("Error! Failed to unmarshal: %s", err)
+	}
+
+	if result.Deadline != deadline {
+		t.Fatal("Error! Payload deadline mismatch")
+	}
+}
+
+func TestPayloadTampered(t *testing.T) {
+	deadline := time.Now().Add(time.Minute).Unix()
+
+	tests := map[string]func(payload *HsmPayload){
+		"id": func(payload *HsmPayload) {
+			payload.Id = "other"
+		},
+		"type": func(payload *HsmPayload) {
+			payload.Type = "jwt_sign"
+		},
+		"timestamp": func(payload *HsmPayload) {
+			payload.Timestamp += 1
+		},
+		"nonce": func(payload *HsmPayload) {
+			payload.Nonce = "other"
+		},
+		"deadline": func(payload *HsmPayload) {
+			payload.Deadline += 60
+		},
+		"deadline_removed": func(payload *HsmPayload) {
+			payload.Deadline = 0
+		},
+		"data": func(payload *HsmPayload) {
+			payload.Data[0] ^= 0xff
+		},
+	}
+
+	for name, tamper := range tests {
+		payload := sealTest(t, "tampered-"+name, deadline)
+		tamper(payload)
+
+		_, _, err := UnmarshalPayload(testToken, testSecret, 0,
+			marshalTest(t, payload))
+		if err == nil {
+			t.Fatalf("Error! Accepted payload with changed %s", name)
+		}
+	}
+}
+
+func TestPayloadReplay(t *testing.T) {
+	defer allowV1()()
+
+	for _, version := range PayloadVersions {
+		payload, err := MarshalPayload(version, "replay", testToken,
+			testSecret, "ssh_certificate", &testData{Value: "data"})
+		if err != nil {
+			t.Fatalf("Error! Failed to marshal v%d: %s", version, err)
+		}
+		raw := marshalTest(t, payload)
+
+		_, _, err = UnmarshalPayload(testToken, testSecret, 0, raw)
+		if err != nil {
+			t.Fatalf("Error! Failed to unmarshal v%d: %s", version, err)
+		}
+
+		_, _, err = UnmarshalPayload(testToken, testSecret, 0, raw)
+		if err == nil {
+			t.Fatalf("Error! Accepted replayed v%d payload", version)
+		}
+	}
+}
+
+func TestPayloadMinVersion(t *testing.T) {
+	defer allowV1()()
+
+	payload, err := MarshalPayload(PayloadVersion1, "min-version",
+		testToken, testSecret, "ssh_certificate", &testData{Value: "data"})
+	if err != nil {
+		t.Fatalf("Error! Failed to marshal: %s", err)
+	}
+	raw := marshalTest(t, payload)
+
+	_, _, err = UnmarshalPayload(testToken, testSecret,
+		PayloadVersion2, raw)
+	if err == nil {
+		t.Fatal("Error! Accepted payload below connection version")
+	}
+
+	config.Config.MinPayloadVersion = PayloadVersion2
+	defer func() {
+		config.Config.MinPayloadVersion = 0
+	}()
+
+	_, _, err = UnmarshalPayload(testToken, testSecret, 0, raw)
+	if err == nil {
+		t.Fatal("Error! Accepted payload below minimum version")
+	}
+}
+
+func TestPayloadInvalidToken(t *testing.T) {
+	payload := sealTest(t, "invalid-token", 0)
+
+	_, _, err := UnmarshalPayload("other-token", testSecret, 0,
+		marshalTest(t, payload))
+	if err == nil {
+		t.Fatal("Error! Accepted payload with wrong token")
+	}
+}
+
+func TestPayloadV1NotAllowed(t *testing.T) {
+	payload, err := MarshalPayload(PayloadVersion1, "v1-not-allowed",
+		testToken, testSecret, "ssh_certificate", &testData{Value: "data"})
+	if err != nil {
+		t.Fatalf("Error! Failed to marshal: %s", err)
+	}
+
+	_, _, err = UnmarshalPayload(testToken, testSecret, 0,
+		marshalTest(t, payload))
+	if err == nil {
+		t.Fatal("Error! Accepted v1 payload without opt in")
+	}
+}
+
+func TestPayloadV1ReplayAfterWindow(t *testing.T) {
+	defer allowV1()()
+
+	payload, err := MarshalPayload(PayloadVersion1, "v1-replay-window",
+		testToken, testSecret, "ssh_certificate", &testData{Value: "data"})
+	if err != nil {
+		t.Fatalf("Error! Failed to marshal: %s", err)
+	}
+	raw := marshalTest(t, payload)
+
+	_, _, err = UnmarshalPayload(testToken, testSecret, 0, raw)
+	if err != nil {
+		t.Fatalf("Error! Failed to unmarshal: %s", err)
+	}
+
+	window := time.Duration(config.DefaultReplayWindow) * time.Second
+
+	payloadCache.lock.Lock()
+	payloadCache.expire(time.Now().Add(2 * window))
+	payloadCache.lock.Unlock()
+
+	_, _, err = UnmarshalPayload(testToken, testSecret, 0, raw)
+	if err == nil {
+		t.Fatal("Error! Accepted v1 payload replayed after window")
+	}
+}
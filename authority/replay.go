@@ -0,0 +1,128 @@
+package authority
+
+import (
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-hsm/config"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"sync"
+	"time"
+)
+
+var (
+	payloadCache = &replayCache{
+		seen:       map[string]time.Time{},
+		persistent: map[string]bool{},
+	}
+)
+
+type replayEntry struct {
+	key     string
+	expires time.Time
+}
+
+// Version 1 payloads do not have an authenticated timestamp, their
+// signatures are kept in the persistent set and never expire
+type replayCache struct {
+	lock       sync.Mutex
+	seen       map[string]time.Time
+	persistent map[string]bool
+	queue      []replayEntry
+}
+
+// Entries are removed in the order received, an entry with a later expiry
+// holds back the entries behind it for at most one window
+func (r *replayCache) expire(now time.Time) {
+	i := 0
+	for ; i < len(r.queue); i++ {
+		entry := r.queue[i]
+		if !now.After(entry.expires) {
+			break
+		}
+		delete(r.seen, entry.key)
+	}
+	r.queue = r.queue[i:]
+}
+
+func (r *replayCache) Check(payload *HsmPayload) (err error) {
+	window := time.Duration(config.Config.ReplayWindow) * time.Second
+	if window == 0 {
+		window = time.Duration(config.DefaultReplayWindow) * time.Second
+	}
+
+	cacheSize := config.Config.ReplayCacheSize
+	if cacheSize == 0 {
+		cacheSize = config.DefaultReplayCacheSize
+	}
+
+	now := time.Now()
+
+	var key string
+	if payload.Version >= PayloadVersion2 {
+		if payload.Nonce == "" {
+			err = &errortypes.AuthenticationError{
+				errors.New("authority: Payload missing nonce"),
+			}
+			return
+		}
+
+		key = payload.Token + "&" + payload.Id + "&" + payload.Nonce
+	} else {
+		key = payload.Token + "&" + payload.Signature
+	}
+
+	// Entries are kept until the payload timestamp can no longer pass the
+	// window check, a payload stamped in the future is kept past now
+	expires := now.Add(window)
+
+	if payload.Timestamp != 0 {
+		timestamp := time.Unix(payload.Timestamp, 0)
+		if now.Sub(timestamp) > window || timestamp.Sub(now) > window {
+			err = &errortypes.AuthenticationError{
+				errors.New("authority: Payload timestamp outside " +
+					"replay window"),
+			}
+			return
+		}
+
+		if timestamp.After(now) {
+			expires = timestamp.Add(window)
+		}
+	} else if payload.Version >= PayloadVersion2 {
+		err = &errortypes.AuthenticationError{
+			errors.New("authority: Payload missing timestamp"),
+		}
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.expire(now)
+
+	if _, ok := r.seen[key]; ok || r.persistent[key] {
+		err = &errortypes.AuthenticationError{
+			errors.New("authority: Duplicate payload rejected"),
+		}
+		return
+	}
+
+	if len(r.seen)+len(r.persistent) >= cacheSize {
+		err = &errortypes.AuthenticationError{
+			errors.New("authority: Replay cache full, payload rejected"),
+		}
+		return
+	}
+
+	if payload.Version < PayloadVersion2 {
+		r.persistent[key] = true
+		return
+	}
+
+	r.seen[key] = expires
+	r.queue = append(r.queue, replayEntry{
+		key:     key,
+		expires: expires,
+	})
+
+	return
+}
@@ -0,0 +1,241 @@
+package authority
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/Sirupsen/logrus"
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-hsm/config"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"github.com/pritunl/pritunl-hsm/ykpiv"
+	"github.com/pritunl/pritunl-hsm/yubikey"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	attestations     = map[string]*ResponseKeyStatus{}
+	attestationsLock = sync.Mutex{}
+
+	// Liveness, status and touch notifications are only authenticated
+	// with the payload secret so they are never delayed by the key lock
+	unsignedPayloadTypes = map[string]bool{
+		"status":        true,
+		"capabilities":  true,
+		"heartbeat":     true,
+		"touch_pending": true,
+	}
+)
+
+func getPayloadSigData(payload *HsmPayload) []byte {
+	return []byte(strings.Join([]string{
+		strconv.Itoa(payload.Version),
+		payload.Id,
+		payload.Token,
+		strconv.FormatInt(payload.Timestamp, 10),
+		payload.Nonce,
+		payload.Type,
+		base64.StdEncoding.EncodeToString(payload.Iv),
+		base64.StdEncoding.EncodeToString(payload.Data),
+		payload.Signature,
+	}, "&"))
+}
+
+func getResponseAlgorithm(pubKey crypto.PublicKey) (
+	algo string, hash crypto.Hash, err error) {
+
+	switch key := pubKey.(type) {
+	case *rsa.PublicKey:
+		algo = "rsa-pkcs1v15-sha256"
+		hash = crypto.SHA256
+	case *ecdsa.PublicKey:
+		switch key.Params().BitSize {
+		case 256:
+			algo = "ecdsa-sha256"
+			hash = crypto.SHA256
+		case 384:
+			algo = "ecdsa-sha384"
+			hash = crypto.SHA384
+		}
+	}
+
+	if algo == "" {
+		err = &errortypes.ParseError{
+			errors.New("authority: Unsupported response key algorithm"),
+		}
+		return
+	}
+
+	return
+}
+
+func getResponseSlot(serial string) (slotId ykpiv.SlotId,
+	ok bool, err error) {
+
+	slotName := config.Config.GetKey(serial).ResponseSlot
+	if slotName == "" {
+		return
+	}
+
+	slotId, err = yubikey.ParseSlot(slotName)
+	if err != nil {
+		return
+	}
+
+	ok = true
+
+	return
+}
+
+func SignPayload(serial string, payload *HsmPayload) (err error) {
+	if unsignedPayloadTypes[payload.Type] {
+		return
+	}
+
+	slotId, ok, err := getResponseSlot(serial)
+	if err != nil || !ok {
+		return
+	}
+
+	yubi := yubikey.GetKey(serial)
+	if yubi == nil {
+		err = &errortypes.NotFoundError{
+			errors.New("authority: Failed to find hsm"),
+		}
+		return
+	}
+
+	yubikey.LockKey(serial)
+
+	slot, err := yubi.Slot(slotId)
+	if err != nil {
+		yubikey.UnlockKey(serial)
+		return
+	}
+
+	algo, hash, err := getResponseAlgorithm(slot.Public())
+	if err != nil {
+		yubikey.UnlockKey(serial)
+		return
+	}
+
+	var digest []byte
+	if hash == crypto.SHA384 {
+		sum := sha512.Sum384(getPayloadSigData(payload))
+		digest = sum[:]
+	} else {
+		sum := sha256.Sum256(getPayloadSigData(payload))
+		digest = sum[:]
+	}
+
+	sig, err := slot.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		yubikey.UnlockKey(serial)
+		err = &errortypes.DeviceError{
+			errors.Wrap(err, "authority: Failed to sign response"),
+		}
+		return
+	}
+
+	yubikey.UnlockKey(serial)
+
+	payload.HsmSignature = sig
+	payload.HsmSignatureAlgorithm = algo
+
+	return
+}
+
+func getResponseKeyStatus(serial string) (
+	status *ResponseKeyStatus, err error) {
+
+	slotId, ok, err := getResponseSlot(serial)
+	if err != nil || !ok {
+		return
+	}
+
+	cacheKey := serial + "&" + slotId.String()
+
+	attestationsLock.Lock()
+	status = attestations[cacheKey]
+	attestationsLock.Unlock()
+	if status != nil {
+		return
+	}
+
+	yubi := yubikey.GetKey(serial)
+	if yubi == nil {
+		err = &errortypes.NotFoundError{
+			errors.New("authority: Failed to find hsm"),
+		}
+		return
+	}
+
+	yubikey.LockKey(serial)
+
+	slot, err := yubi.Slot(slotId)
+	if err != nil {
+		yubikey.UnlockKey(serial)
+		return
+	}
+
+	attestCert, attestErr := yubi.Attest(slotId)
+	var intermediateCert *x509.Certificate
+	if attestErr == nil {
+		intermediateCert, attestErr = yubi.AttestationCertificate()
+	}
+
+	yubikey.UnlockKey(serial)
+
+	algo, _, err := getResponseAlgorithm(slot.Public())
+	if err != nil {
+		return
+	}
+
+	pubKey, err := x509.MarshalPKIXPublicKey(slot.Public())
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "authority: Failed to marshal response key"),
+		}
+		return
+	}
+
+	status = &ResponseKeyStatus{
+		Slot:      slotId.String(),
+		Algorithm: algo,
+		PublicKey: string(pem.EncodeToMemory(&pem.Block{
+			Type:  "PUBLIC KEY",
+			Bytes: pubKey,
+		})),
+	}
+
+	if attestErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"slot":  slotId.String(),
+			"error": attestErr,
+		}).Warn("authority: Response key attestation unavailable")
+	} else {
+		status.Attestation = string(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: attestCert.Raw,
+		}))
+		status.AttestationIntermediate = string(pem.EncodeToMemory(
+			&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: intermediateCert.Raw,
+			}))
+	}
+
+	attestationsLock.Lock()
+	attestations[cacheKey] = status
+	attestationsLock.Unlock()
+
+	return
+}
@@ -0,0 +1,227 @@
+package authority
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"github.com/pritunl/pritunl-hsm/constants"
+	"github.com/pritunl/pritunl-hsm/ykpiv"
+	"github.com/pritunl/pritunl-hsm/yubikey"
+	"sync"
+	"time"
+)
+
+var (
+	startTime        = time.Now()
+	signStats        = &signCounters{}
+	slotStatuses     = map[string][]*SlotStatus{}
+	slotStatusesLock = sync.Mutex{}
+	pinRetries       = map[string]int{}
+	pinRetriesLock   = sync.Mutex{}
+)
+
+type signCounters struct {
+	lock          sync.Mutex
+	sshSigned     uint64
+	sshFailed     uint64
+	jwtSigned     uint64
+	jwtFailed     uint64
+	lastError     string
+	lastErrorTime int64
+}
+
+func (c *signCounters) record(typ string, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	switch typ {
+	case "ssh":
+		if err == nil {
+			c.sshSigned += 1
+		} else {
+			c.sshFailed += 1
+		}
+	case "jwt":
+		if err == nil {
+			c.jwtSigned += 1
+		} else {
+			c.jwtFailed += 1
+		}
+	}
+
+	if err != nil {
+		c.lastError, c.lastErrorTime = getLastError(err)
+	}
+}
+
+func (c *signCounters) setError(err error) {
+	c.lock.Lock()
+	c.lastError, c.lastErrorTime = getLastError(err)
+	c.lock.Unlock()
+}
+
+func (c *signCounters) status() (status *SignStatus) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	status = &SignStatus{
+		SshSigned:     c.sshSigned,
+		SshFailed:     c.sshFailed,
+		JwtSigned:     c.jwtSigned,
+		JwtFailed:     c.jwtFailed,
+		LastError:     c.lastError,
+		LastErrorTime: c.lastErrorTime,
+	}
+
+	return
+}
+
+func getLastError(err error) (message string, timestamp int64) {
+	class, msg := GetErrorClass(err)
+	message = class + ": " + msg
+	timestamp = time.Now().Unix()
+	return
+}
+
+// Records an error from outside the signing path for the status payload
+func SetLastError(err error) {
+	signStats.setError(err)
+}
+
+func getPinPolicyName(policy ykpiv.PinPolicy) string {
+	switch policy {
+	case ykpiv.PinPolicyNever:
+		return "never"
+	case ykpiv.PinPolicyOnce:
+		return "once"
+	case ykpiv.PinPolicyAlways:
+		return "always"
+	}
+	return ""
+}
+
+func getTouchPolicyName(policy ykpiv.TouchPolicy) string {
+	switch policy {
+	case ykpiv.TouchPolicyNever:
+		return "never"
+	case ykpiv.TouchPolicyAlways:
+		return "always"
+	case ykpiv.TouchPolicyCached:
+		return "cached"
+	}
+	return ""
+}
+
+func getKeyAlgorithm(pubKey crypto.PublicKey) string {
+	switch key := pubKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa%d", key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ecdsa-p%d", key.Params().BitSize)
+	}
+	return ""
+}
+
+// Slot keys and policies can not change while the service is running and
+// are only read from the device once. Must be called while holding the key
+// lock.
+func loadSlotStatuses(serial string, yubi *ykpiv.Yubikey) (
+	statuses []*SlotStatus) {
+
+	statuses = []*SlotStatus{}
+
+	for _, slotId := range []ykpiv.SlotId{
+		ykpiv.Authentication,
+		ykpiv.Signature,
+		ykpiv.KeyManagement,
+		ykpiv.CardAuthentication,
+	} {
+		slot, err := yubi.Slot(slotId)
+		if err != nil {
+			continue
+		}
+
+		status := &SlotStatus{
+			Slot:      slotId.String(),
+			Algorithm: getKeyAlgorithm(slot.Public()),
+		}
+
+		pinPolicy, touchPolicy, err := yubi.Policies(slotId)
+		if err == nil {
+			status.PinPolicy = getPinPolicyName(pinPolicy)
+			status.TouchPolicy = getTouchPolicyName(touchPolicy)
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	slotStatusesLock.Lock()
+	slotStatuses[serial] = statuses
+	slotStatusesLock.Unlock()
+
+	return
+}
+
+// Must be called while holding the key lock
+func loadPinRetries(serial string, yubi *ykpiv.Yubikey) (retries int) {
+	retries, err := yubi.GetPINRetries()
+	if err != nil {
+		retries = -1
+	}
+
+	pinRetriesLock.Lock()
+	pinRetries[serial] = retries
+	pinRetriesLock.Unlock()
+
+	return
+}
+
+// The device is only read when the key is not in use so the status is
+// never delayed by a touch or approval, otherwise the last PIN retry
+// counter is reported. A counter of -1 is unknown.
+func getDeviceStatus(serial string) (status *DeviceStatus, err error) {
+	status = &DeviceStatus{
+		Serial:     serial,
+		Firmware:   yubikey.GetFirmware(serial),
+		PinRetries: -1,
+		Slots:      []*SlotStatus{},
+	}
+
+	slotStatusesLock.Lock()
+	statuses := slotStatuses[serial]
+	slotStatusesLock.Unlock()
+	if statuses != nil {
+		status.Slots = statuses
+	}
+
+	pinRetriesLock.Lock()
+	retries, ok := pinRetries[serial]
+	pinRetriesLock.Unlock()
+	if ok {
+		status.PinRetries = retries
+	}
+
+	yubi := yubikey.GetKey(serial)
+	if yubi == nil || yubikey.KeyLocked(serial) {
+		return
+	}
+
+	yubikey.LockKey(serial)
+	if statuses == nil {
+		status.Slots = loadSlotStatuses(serial, yubi)
+	}
+	status.PinRetries = loadPinRetries(serial, yubi)
+	yubikey.UnlockKey(serial)
+
+	return
+}
+
+func getAgentStatus() (status *AgentStatus) {
+	status = &AgentStatus{
+		Version: constants.Version,
+		Uptime:  int64(time.Since(startTime) / time.Second),
+	}
+
+	return
+}
@@ -0,0 +1,115 @@
+package authority
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-hsm/config"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"github.com/pritunl/pritunl-hsm/ykpiv"
+	"github.com/pritunl/pritunl-hsm/yubikey"
+	"sync"
+	"time"
+)
+
+var (
+	touchPolicies     = map[string]ykpiv.TouchPolicy{}
+	touchPoliciesLock = sync.Mutex{}
+)
+
+// Must be called while holding the key lock
+func getTouchPolicy(serial string, yubi *ykpiv.Yubikey,
+	slotId ykpiv.SlotId) (policy ykpiv.TouchPolicy) {
+
+	switch config.Config.GetKey(serial).TouchPolicy {
+	case "never":
+		policy = ykpiv.TouchPolicyNever
+		return
+	case "always":
+		policy = ykpiv.TouchPolicyAlways
+		return
+	case "cached":
+		policy = ykpiv.TouchPolicyCached
+		return
+	}
+
+	cacheKey := serial + "&" + slotId.String()
+
+	touchPoliciesLock.Lock()
+	policy, ok := touchPolicies[cacheKey]
+	touchPoliciesLock.Unlock()
+	if ok {
+		return
+	}
+
+	_, policy, err := yubi.Policies(slotId)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"slot":  slotId.String(),
+			"error": err,
+		}).Warn("authority: Failed to detect slot touch policy")
+		policy = ykpiv.TouchPolicyNull
+	}
+
+	touchPoliciesLock.Lock()
+	touchPolicies[cacheKey] = policy
+	touchPoliciesLock.Unlock()
+
+	return
+}
+
+func getTouchTimeout(serial string) time.Duration {
+	timeout := config.Config.GetKey(serial).TouchTimeout
+	if timeout == 0 {
+		timeout = config.DefaultTouchTimeout
+	}
+
+	return time.Duration(timeout) * time.Second
+}
+
+// Must be called while holding the key lock. The key stays locked while
+// notifying so the device is not used by another request between loading
+// the slot and signing, touch pending payloads are not signed by the key.
+func notifyTouch(serial string, yubi *ykpiv.Yubikey, slotId ykpiv.SlotId,
+	touchPending func(timeout time.Duration)) {
+
+	if touchPending == nil {
+		return
+	}
+
+	touchPolicy := getTouchPolicy(serial, yubi, slotId)
+	if touchPolicy != ykpiv.TouchPolicyAlways &&
+		touchPolicy != ykpiv.TouchPolicyCached {
+
+		return
+	}
+
+	touchPending(getTouchTimeout(serial))
+}
+
+// Runs the device operation with the key lock held and releases the lock
+// once the operation returns. If the operation does not return within the
+// touch timeout an error is returned while the operation continues to hold
+// the key lock until the device gives up.
+func runLocked(serial string, timeout time.Duration,
+	operation func() error) (err error) {
+
+	done := make(chan error, 1)
+
+	go func() {
+		defer yubikey.UnlockKey(serial)
+		done <- operation()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err = <-done:
+	case <-timer.C:
+		err = &errortypes.TimeoutError{
+			errors.New("authority: Timed out waiting for key touch"),
+		}
+	}
+
+	return
+}
@@ -1,249 +1,401 @@
 package authority
 
 import (
-	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/hmac"
 	"crypto/rand"
-	"crypto/sha256"
-	"crypto/sha512"
-	"crypto/subtle"
-	"encoding/base64"
-	"encoding/json"
+	"github.com/Sirupsen/logrus"
 	"github.com/dropbox/godropbox/errors"
 	"github.com/pritunl/pritunl-hsm/config"
 	"github.com/pritunl/pritunl-hsm/errortypes"
 	"github.com/pritunl/pritunl-hsm/utils"
+	"github.com/pritunl/pritunl-hsm/ykpiv"
 	"github.com/pritunl/pritunl-hsm/yubikey"
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/mgo.v2/bson"
 	"hash/fnv"
+	"sync"
 	"time"
 )
 
-func Sign(hsmSerial string, sshReq *SshRequest) (
-	certMarshaled []byte, err error) {
+func getSshSigner(serial string, slot *ykpiv.Slot) (
+	signer ssh.Signer, err error) {
 
-	if sshReq.Serial != hsmSerial {
-		err = &errortypes.AuthenticationError{
-			errors.Wrap(err, "authority: HSM serial mismatch"),
+	signer, err = ssh.NewSignerFromSigner(slot)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "authority: Failed to load ssh signer"),
 		}
 		return
 	}
 
-	yubi := yubikey.GetKey(sshReq.Serial)
-	if yubi == nil {
-		err = &errortypes.NotFoundError{
-			errors.New("authority: Failed to find hsm"),
+	if signer.PublicKey().Type() != ssh.KeyAlgoRSA {
+		return
+	}
+
+	algo := config.Config.GetKey(serial).SshAlgorithm
+	if algo == "" {
+		algo = config.DefaultSshAlgorithm
+	}
+
+	switch algo {
+	case ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256:
+		break
+	default:
+		err = &errortypes.ParseError{
+			errors.Newf("authority: Unsupported ssh algorithm '%s'", algo),
+		}
+		return
+	}
+
+	algoSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		err = &errortypes.ParseError{
+			errors.New("authority: Signer does not support algorithms"),
 		}
 		return
 	}
 
-	cert, err := utils.UnmarshalSshCertificate(sshReq.Certificate)
+	signer, err = ssh.NewSignerWithAlgorithms(algoSigner, []string{algo})
 	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "authority: Failed to load ssh algorithm signer"),
+		}
 		return
 	}
 
-	serialHash := fnv.New64a()
-	serialHash.Write([]byte(bson.NewObjectId().Hex()))
-	cert.Serial = serialHash.Sum64()
+	return
+}
+
+func getValidity(cert *ssh.Certificate) (
+	validAfter, validBefore uint64, err error) {
 
 	maxCertExpire := config.Config.MaxCertificateExpire
 	if maxCertExpire == 0 {
 		maxCertExpire = config.DefaultMaxCertificateExpire
 	}
 
-	validAfter := uint64(time.Now().Add(-3 * time.Minute).Unix())
-	validBefore := uint64(time.Now().Add(
-		time.Duration(maxCertExpire) * time.Second).Unix())
+	minCertExpire := config.Config.MinCertificateExpire
+	if minCertExpire == 0 {
+		minCertExpire = config.DefaultMinCertificateExpire
+	}
 
-	validBefore = utils.Min(validBefore, cert.ValidBefore)
-	if validBefore <= validAfter {
-		err = &errortypes.ParseError{
-			errors.New(
-				"authority: Certificate expire out of range, check clock"),
+	certBackdate := config.Config.CertificateBackdate
+	if certBackdate == 0 {
+		certBackdate = config.DefaultCertificateBackdate
+	}
+
+	maxCertSkew := config.Config.MaxCertificateSkew
+	if maxCertSkew == 0 {
+		maxCertSkew = config.DefaultMaxCertificateSkew
+	}
+
+	now := time.Now()
+	nowUnix := uint64(now.Unix())
+
+	if cert.ValidAfter > uint64(now.Add(
+		time.Duration(maxCertSkew)*time.Second).Unix()) {
+
+		err = &errortypes.PolicyError{
+			errors.New("authority: Certificate valid after too far " +
+				"in future, check clock"),
 		}
 		return
 	}
 
-	cert.ValidAfter = validAfter
-	cert.ValidBefore = validBefore
+	requestStart := utils.Max(cert.ValidAfter, nowUnix)
+	if cert.ValidBefore <= requestStart {
+		err = &errortypes.PolicyError{
+			errors.New("authority: Certificate expire out of range, " +
+				"check clock"),
+		}
+		return
+	}
 
-	yubikey.LockKey(sshReq.Serial)
+	if cert.ValidBefore-requestStart > uint64(maxCertExpire) ||
+		cert.ValidBefore > uint64(now.Add(
+			time.Duration(maxCertExpire+maxCertSkew)*time.Second).Unix()) {
 
-	slot, err := yubi.Authentication()
-	if err != nil {
+		err = &errortypes.PolicyError{
+			errors.New("authority: Certificate lifetime exceeds policy"),
+		}
+		return
+	}
+
+	// Compared without subtracting so an expired certificate can not
+	// underflow the remaining lifetime
+	if cert.ValidBefore < nowUnix+uint64(minCertExpire) {
+		err = &errortypes.PolicyError{
+			errors.New("authority: Certificate lifetime below minimum, " +
+				"check clock"),
+		}
 		return
 	}
 
-	signer, err := ssh.NewSignerFromSigner(slot)
+	validAfter = uint64(now.Add(
+		-time.Duration(certBackdate) * time.Second).Unix())
+	validBefore = cert.ValidBefore
+
+	return
+}
+
+func prepareCert(hsmSerial string, sshReq *SshRequest) (
+	cert *ssh.Certificate, err error) {
+
+	if sshReq.Serial != hsmSerial {
+		err = &errortypes.AuthenticationError{
+			errors.New("authority: HSM serial mismatch"),
+		}
+		return
+	}
+
+	cert, err = utils.UnmarshalSshCertificate(sshReq.Certificate)
 	if err != nil {
-		yubikey.UnlockKey(sshReq.Serial)
 		return
 	}
 
-	err = cert.SignCert(rand.Reader, signer)
+	err = checkSubjectKey(hsmSerial, cert)
 	if err != nil {
-		yubikey.UnlockKey(sshReq.Serial)
 		return
 	}
 
-	yubikey.UnlockKey(sshReq.Serial)
+	serialHash := fnv.New64a()
+	serialHash.Write([]byte(bson.NewObjectId().Hex()))
+	cert.Serial = serialHash.Sum64()
 
-	certMarshaled, err = utils.MarshalSshCertificate(cert)
+	validAfter, validBefore, err := getValidity(cert)
 	if err != nil {
 		return
 	}
 
-	return
-}
-
-func UnmarshalPayload(token, secret string, payloadJson []byte) (
-	payloadId, payloadType string, data []byte, err error) {
+	cert.ValidAfter = validAfter
+	cert.ValidBefore = validBefore
 
-	payload := &HsmPayload{}
-	err = json.Unmarshal(payloadJson, payload)
+	err = issueLimiter.Take(cert.KeyId, cert.ValidPrincipals)
 	if err != nil {
-		err = &errortypes.ParseError{
-			errors.Wrap(err, "authority: Failed to unmarshal payload"),
-		}
 		return
 	}
 
-	if payload.Id == "" || payload.Token == "" || payload.Iv == nil ||
-		payload.Data == nil {
-
-		err = &errortypes.ParseError{
-			errors.Wrap(err, "authority: Invalid payload"),
+	if requiresApproval(cert) {
+		err = waitApproval(hsmSerial, cert)
+		if err != nil {
+			return
 		}
-		return
 	}
 
-	if subtle.ConstantTimeCompare([]byte(token),
-		[]byte(payload.Token)) != 1 {
+	return
+}
+
+func signCerts(serial string, certs []*ssh.Certificate, deadline time.Time,
+	touchPending func(timeout time.Duration)) (errs []error, err error) {
 
-		err = &errortypes.AuthenticationError{
-			errors.Wrap(err, "authority: Invalid token"),
+	yubi := yubikey.GetKey(serial)
+	if yubi == nil {
+		err = &errortypes.NotFoundError{
+			errors.New("authority: Failed to find hsm"),
 		}
 		return
 	}
 
-	cipData := payload.Data
-	hashFunc := hmac.New(sha512.New, []byte(secret))
-	hashFunc.Write(cipData)
-	rawSignature := hashFunc.Sum(nil)
-	sig := base64.StdEncoding.EncodeToString(rawSignature)
+	err = checkDeadline(deadline)
+	if err != nil {
+		return
+	}
 
-	if subtle.ConstantTimeCompare([]byte(sig),
-		[]byte(payload.Signature)) != 1 {
+	yubikey.LockKey(serial)
 
-		err = &errortypes.AuthenticationError{
-			errors.Wrap(err, "authority: Invalid signature"),
-		}
+	err = checkDeadline(deadline)
+	if err != nil {
+		yubikey.UnlockKey(serial)
 		return
 	}
 
-	encKeyHash := sha256.New()
-	encKeyHash.Write([]byte(secret))
-	cipKey := encKeyHash.Sum(nil)
-	cipIv := payload.Iv
-
-	if len(cipIv) != aes.BlockSize {
-		err = &errortypes.ParseError{
-			errors.Wrap(err, "authority: Invalid payload iv length"),
-		}
+	slot, err := yubi.Authentication()
+	if err != nil {
+		yubikey.UnlockKey(serial)
 		return
 	}
 
-	if len(cipData) == 0 || len(cipData)%16 != 0 {
-		err = &errortypes.ParseError{
-			errors.Wrap(err, "authority: Invalid payload data length"),
-		}
+	signer, err := getSshSigner(serial, slot)
+	if err != nil {
+		yubikey.UnlockKey(serial)
 		return
 	}
 
-	block, err := aes.NewCipher(cipKey)
+	notifyTouch(serial, yubi, slot.Id, touchPending)
+
+	err = checkDeadline(deadline)
 	if err != nil {
-		err = &errortypes.ParseError{
-			errors.Wrap(err, "authority: Failed to load cipher"),
-		}
+		yubikey.UnlockKey(serial)
 		return
 	}
 
-	mode := cipher.NewCBCDecrypter(block, cipIv)
-	mode.CryptBlocks(cipData, cipData)
-	cipData = bytes.TrimRight(cipData, "\x00")
+	signErrs := make([]error, len(certs))
+
+	err = runLocked(serial,
+		getTouchTimeout(serial)*time.Duration(len(certs)),
+		func() error {
+			for i, cert := range certs {
+				e := cert.SignCert(rand.Reader, signer)
+				if e != nil {
+					signErrs[i] = &errortypes.DeviceError{
+						errors.Wrap(e,
+							"authority: Failed to sign certificate"),
+					}
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return
+	}
 
-	payloadId = payload.Id
-	payloadType = payload.Type
-	data = cipData
+	errs = signErrs
 
 	return
 }
 
-func MarshalPayload(id, token, secret, typ string, data interface{}) (
-	payload *HsmPayload, err error) {
+func Sign(hsmSerial string, sshReq *SshRequest, deadline time.Time,
+	touchPending func(timeout time.Duration)) (
+	certMarshaled []byte, err error) {
+
+	defer func() {
+		signStats.record("ssh", err)
+	}()
 
-	cipData, err := json.Marshal(data)
+	cert, err := prepareCert(hsmSerial, sshReq)
 	if err != nil {
-		err = &errortypes.ParseError{
-			errors.Wrap(err, "authority: Failed to marshal payload"),
-		}
 		return
 	}
 
-	pad := 16 - len(cipData)%16
-	for i := 0; i < pad; i++ {
-		cipData = append(cipData, 0)
+	errs, err := signCerts(hsmSerial, []*ssh.Certificate{cert},
+		deadline, touchPending)
+	if err != nil {
+		return
 	}
 
-	encKeyHash := sha256.New()
-	encKeyHash.Write([]byte(secret))
-	cipKey := encKeyHash.Sum(nil)
-
-	cipIv, err := utils.RandBytes(aes.BlockSize)
+	err = errs[0]
 	if err != nil {
 		return
 	}
 
-	block, err := aes.NewCipher(cipKey)
+	certMarshaled, err = utils.MarshalSshCertificate(cert)
 	if err != nil {
-		err = &errortypes.ParseError{
-			errors.Wrap(err, "authority: Failed to load cipher"),
+		return
+	}
+
+	return
+}
+
+func SignBatch(hsmSerial string, batchReq *SshBatchRequest,
+	deadline time.Time, touchPending func(timeout time.Duration)) (
+	results []*SignResult, err error) {
+
+	defer func() {
+		if err != nil {
+			signStats.record("ssh", err)
+			return
+		}
+
+		for _, result := range results {
+			signStats.record("ssh", result.Error)
+		}
+	}()
+
+	maxBatchSize := config.Config.MaxBatchSize
+	if maxBatchSize == 0 {
+		maxBatchSize = config.DefaultMaxBatchSize
+	}
+
+	if len(batchReq.Requests) > maxBatchSize {
+		err = &errortypes.PolicyError{
+			errors.New("authority: Certificate batch exceeds max size"),
 		}
 		return
 	}
 
-	mode := cipher.NewCBCEncrypter(block, cipIv)
-	mode.CryptBlocks(cipData, cipData)
+	results = make([]*SignResult, len(batchReq.Requests))
+	certs := make([]*ssh.Certificate, len(batchReq.Requests))
 
-	hashFunc := hmac.New(sha512.New, []byte(secret))
-	hashFunc.Write(cipData)
-	rawSignature := hashFunc.Sum(nil)
-	sig := base64.StdEncoding.EncodeToString(rawSignature)
+	waiter := sync.WaitGroup{}
+	for i, sshReq := range batchReq.Requests {
+		results[i] = &SignResult{}
 
-	payload = &HsmPayload{
-		Id:        id,
-		Token:     token,
-		Iv:        cipIv,
-		Signature: sig,
-		Type:      typ,
-		Data:      cipData,
+		waiter.Add(1)
+		go func(i int, sshReq *SshRequest) {
+			defer waiter.Done()
+			certs[i], results[i].Error = prepareCert(hsmSerial, sshReq)
+		}(i, sshReq)
+	}
+	waiter.Wait()
+
+	signIndexes := []int{}
+	signCertsList := []*ssh.Certificate{}
+	for i, result := range results {
+		if result.Error == nil {
+			signIndexes = append(signIndexes, i)
+			signCertsList = append(signCertsList, certs[i])
+		}
+	}
+
+	if len(signCertsList) == 0 {
+		return
+	}
+
+	errs, e := signCerts(hsmSerial, signCertsList, deadline, touchPending)
+	for n, i := range signIndexes {
+		if e != nil {
+			results[i].Error = e
+			continue
+		}
+
+		if errs[n] != nil {
+			results[i].Error = errs[n]
+			continue
+		}
+
+		results[i].Certificate, results[i].Error =
+			utils.MarshalSshCertificate(certs[i])
 	}
 
 	return
 }
 
-func GetStatusPayload(token, secret, serial string) (
-	payload *HsmPayload, err error) {
+func GetStatusPayload(version int, token, secret, serial string,
+	connections *ConnectionStatus) (payload *HsmPayload, err error) {
+
+	device, e := getDeviceStatus(serial)
+	if e != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": e,
+		}).Error("authority: Failed to load device status")
+	}
+
+	responseKey, e := getResponseKeyStatus(serial)
+	if e != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": e,
+		}).Error("authority: Failed to load response key status")
+	}
+
+	keySet, e := getJwks(serial)
+	if e != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": e,
+		}).Error("authority: Failed to load JWT key set")
+	}
 
 	data := &HsmStatus{
 		Status:       "online",
 		SshPublicKey: yubikey.GetPublicKey(serial),
+		Device:       device,
+		Agent:        getAgentStatus(),
+		Connections:  connections,
+		Signing:      signStats.status(),
+		RateLimits:   issueLimiter.Status(),
+		ResponseKey:  responseKey,
+		Jwks:         keySet,
 	}
 
-	payload, err = MarshalPayload(
+	payload, err = MarshalPayload(version,
 		bson.NewObjectId().Hex(), token, secret, "status", data)
 	if err != nil {
 		return
@@ -251,3 +403,38 @@ func GetStatusPayload(token, secret, serial string) (
 
 	return
 }
+
+func GetAlertPayload(version int, token, secret, typ, message string) (
+	payload *HsmPayload, err error) {
+
+	data := &HsmAlert{
+		Type:      typ,
+		Message:   message,
+		Timestamp: time.Now().Unix(),
+	}
+
+	payload, err = MarshalPayload(version,
+		bson.NewObjectId().Hex(), token, secret, "alert", data)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func GetTouchPendingPayload(version int, id, token, secret, serial string,
+	timeout time.Duration) (payload *HsmPayload, err error) {
+
+	data := &TouchPending{
+		Serial:  serial,
+		Timeout: int(timeout / time.Second),
+	}
+
+	payload, err = MarshalPayload(
+		version, id, token, secret, "touch_pending", data)
+	if err != nil {
+		return
+	}
+
+	return
+}
@@ -0,0 +1,72 @@
+package authority
+
+import (
+	"github.com/pritunl/pritunl-hsm/config"
+	"golang.org/x/crypto/ssh"
+	"testing"
+	"time"
+)
+
+func TestGetValidity(t *testing.T) {
+	defer setTestConfig(&config.ConfigData{})()
+
+	now := uint64(time.Now().Unix())
+	maxExpire := uint64(config.DefaultMaxCertificateExpire)
+
+	tests := []struct {
+		name        string
+		validAfter  uint64
+		validBefore uint64
+		valid       bool
+	}{
+		{"one_hour", now, now + 3600, true},
+		{"after_zero", 0, now + 3600, true},
+		{"after_past", now - 3600, now + 3600, true},
+		{"after_within_skew", now + 290, now + 3600, true},
+		{"after_beyond_skew", now + 310, now + 3600, false},
+		{"after_infinity", ssh.CertTimeInfinity, now + 3600, false},
+		{"before_zero", 0, 0, false},
+		{"before_expired", now - 3600, now - 10, false},
+		{"before_now", now, now, false},
+		{"before_after_after", now + 200, now + 100, false},
+		{"below_min_expire", now, now + 30, false},
+		{"above_min_expire", now, now + 120, true},
+		{"max_expire", now, now + maxExpire - 10, true},
+		{"above_max_expire", now, now + maxExpire + 10, false},
+		{"before_infinity", now, ssh.CertTimeInfinity, false},
+		{"future_max_expire", now + 200, now + 200 + maxExpire - 10, true},
+		{"future_above_max_expire", now + 200, now + 200 + maxExpire + 10,
+			false},
+	}
+
+	for _, test := range tests {
+		cert := &ssh.Certificate{
+			ValidAfter:  test.validAfter,
+			ValidBefore: test.validBefore,
+		}
+
+		validAfter, validBefore, err := getValidity(cert)
+		if !test.valid {
+			if err == nil {
+				t.Fatalf("Error! Test %s accepted invalid validity",
+					test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("Error! Test %s rejected valid validity: %s",
+				test.name, err)
+		}
+
+		if validBefore != test.validBefore {
+			t.Fatalf("Error! Test %s valid before changed", test.name)
+		}
+
+		backdate := now - uint64(config.DefaultCertificateBackdate)
+		if validAfter < backdate || validAfter > backdate+5 {
+			t.Fatalf("Error! Test %s valid after not backdated",
+				test.name)
+		}
+	}
+}
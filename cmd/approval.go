@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/pritunl/pritunl-hsm/admin"
+	"github.com/pritunl/pritunl-hsm/authority"
+	"sort"
+	"strings"
+	"time"
+)
+
+func formatOptions(options map[string]string) string {
+	keys := []string{}
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := []string{}
+	for _, key := range keys {
+		if options[key] == "" {
+			values = append(values, key)
+		} else {
+			values = append(values, key+"="+options[key])
+		}
+	}
+
+	if len(values) == 0 {
+		return "-"
+	}
+
+	return strings.Join(values, ",")
+}
+
+func Approvals() (err error) {
+	approvals := []*authority.Approval{}
+
+	err = admin.Request("GET", "/approval", &approvals)
+	if err != nil {
+		return
+	}
+
+	if len(approvals) == 0 {
+		fmt.Println("No pending approvals")
+		return
+	}
+
+	for _, approval := range approvals {
+		principals := strings.Join(approval.Principals, ",")
+		if principals == "" {
+			principals = "* (any)"
+		}
+
+		fmt.Printf("%s  %s  key_id=%s  principals=%s  expires=%s\n",
+			approval.Id,
+			approval.CertType,
+			approval.KeyId,
+			principals,
+			time.Unix(approval.Expires, 0).Format(time.RFC3339),
+		)
+		fmt.Printf("    fingerprint=%s\n", approval.Fingerprint)
+		fmt.Printf("    critical_options=%s\n",
+			formatOptions(approval.CriticalOptions))
+		fmt.Printf("    extensions=%s\n",
+			formatOptions(approval.Extensions))
+	}
+
+	return
+}
+
+func Approve(id string) (err error) {
+	err = admin.Request("PUT", "/approval/"+id+"/approve", nil)
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("Approved %s\n", id)
+
+	return
+}
+
+func Deny(id string) (err error) {
+	err = admin.Request("PUT", "/approval/"+id+"/deny", nil)
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("Denied %s\n", id)
+
+	return
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-hsm/config"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"github.com/pritunl/pritunl-hsm/utils"
+	"github.com/pritunl/pritunl-hsm/yubikey"
+	"golang.org/x/crypto/ssh"
+	"sort"
+)
+
+type caKey struct {
+	Serial string
+	Key    ssh.PublicKey
+}
+
+// The CA keys are read without a PIN login. Connecting to the device
+// selects the PIV applet which can clear the PIN verification of a running
+// service, the service must be stopped before exporting.
+func getCaKeys() (caKeys []*caKey, err error) {
+	err = config.Init()
+	if err != nil {
+		return
+	}
+
+	err = yubikey.InitPublic()
+	if err != nil {
+		return
+	}
+
+	pubKeys := yubikey.GetSshPublicKeys()
+	if len(pubKeys) == 0 {
+		err = &errortypes.NotFoundError{
+			errors.New("cmd: No CA keys found"),
+		}
+		return
+	}
+
+	caKeys = []*caKey{}
+	for serial, pubKey := range pubKeys {
+		caKeys = append(caKeys, &caKey{
+			Serial: serial,
+			Key:    pubKey,
+		})
+	}
+
+	sort.Slice(caKeys, func(i, j int) bool {
+		return caKeys[i].Serial < caKeys[j].Serial
+	})
+
+	return
+}
+
+func ExportUserCa() (err error) {
+	caKeys, err := getCaKeys()
+	if err != nil {
+		return
+	}
+
+	for _, key := range caKeys {
+		fmt.Printf("%s pritunl-hsm-%s\n",
+			utils.MarshalPublicKey(key.Key), key.Serial)
+	}
+
+	return
+}
+
+func ExportHostCa(hostPatterns string) (err error) {
+	caKeys, err := getCaKeys()
+	if err != nil {
+		return
+	}
+
+	if hostPatterns == "" {
+		hostPatterns = "*"
+	}
+
+	for _, key := range caKeys {
+		fmt.Printf("@cert-authority %s %s pritunl-hsm-%s\n",
+			hostPatterns, utils.MarshalPublicKey(key.Key), key.Serial)
+	}
+
+	return
+}
+
+func Fingerprint() (err error) {
+	caKeys, err := getCaKeys()
+	if err != nil {
+		return
+	}
+
+	for _, key := range caKeys {
+		fmt.Printf("%s pritunl-hsm-%s (%s)\n",
+			ssh.FingerprintSHA256(key.Key), key.Serial, key.Key.Type())
+		fmt.Printf("MD5:%s pritunl-hsm-%s (%s)\n",
+			ssh.FingerprintLegacyMD5(key.Key), key.Serial, key.Key.Type())
+	}
+
+	return
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"context"
+	"github.com/Sirupsen/logrus"
+	"github.com/pritunl/pritunl-hsm/admin"
+	"github.com/pritunl/pritunl-hsm/config"
+	"github.com/pritunl/pritunl-hsm/logger"
+	"github.com/pritunl/pritunl-hsm/socket"
+	"github.com/pritunl/pritunl-hsm/yubikey"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func Service() (err error) {
+	err = config.Init()
+	if err != nil {
+		return
+	}
+
+	logCtx, logCancel := context.WithCancel(context.Background())
+	defer logCancel()
+
+	logger.Init(logCtx)
+
+	err = yubikey.Init()
+	if err != nil {
+		return
+	}
+
+	err = admin.Init()
+	if err != nil {
+		return
+	}
+
+	logrus.Info("main: Starting sockets")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = socket.Init(ctx)
+	if err != nil {
+		return
+	}
+
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	logrus.Info("main: Shutting down")
+
+	socket.Drain()
+	cancel()
+	socket.Wait()
+
+	return
+}
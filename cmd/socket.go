@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/pritunl/pritunl-hsm/admin"
+	"github.com/pritunl/pritunl-hsm/socket"
+	"time"
+)
+
+func Sockets() (err error) {
+	statuses := []*socket.SocketStatus{}
+
+	err = admin.Request("GET", "/socket", &statuses)
+	if err != nil {
+		return
+	}
+
+	if len(statuses) == 0 {
+		fmt.Println("No Pritunl Zero hosts configured")
+		return
+	}
+
+	for _, status := range statuses {
+		state := fmt.Sprintf("connected  latency=%dms  heartbeat=%dms  "+
+			"missed=%d", status.Latency, status.HeartbeatLatency,
+			status.MissedHeartbeats)
+		if !status.Connected {
+			state = fmt.Sprintf("disconnected  attempts=%d  backoff=%ds",
+				status.Attempts, status.Backoff)
+		}
+
+		fmt.Printf("%s  %s\n", status.Host, state)
+
+		if status.LastError != "" {
+			fmt.Printf("  last_error=%s  at=%s\n", status.LastError,
+				time.Unix(status.LastErrorTime, 0).Format(time.RFC3339))
+		}
+	}
+
+	return
+}
@@ -5,11 +5,38 @@ import (
 	"github.com/dropbox/godropbox/errors"
 	"github.com/pritunl/pritunl-hsm/constants"
 	"github.com/pritunl/pritunl-hsm/errortypes"
+	"golang.org/x/crypto/ssh"
 	"io/ioutil"
+	"strings"
 )
 
 const (
 	DefaultMaxCertificateExpire = 28800
+	DefaultMinCertificateExpire = 60
+	DefaultCertificateBackdate  = 180
+	DefaultMaxCertificateSkew   = 300
+	DefaultSshAlgorithm         = "rsa-sha2-512"
+	DefaultReplayWindow         = 300
+	DefaultReplayCacheSize      = 65536
+	DefaultApprovalTimeout      = 300
+	DefaultTouchTimeout         = 30
+	DefaultMaxBatchSize         = 100
+	DefaultJwtMaxExpire         = 3600
+	DefaultMinRsaBits           = 2048
+	DefaultWorkerCount          = 4
+	DefaultWorkerQueueSize      = 64
+	DefaultShutdownTimeout      = 30
+
+	// Rate limits are certificates issued per minute, the burst is the
+	// number of certificates that can be issued at once
+	DefaultRateLimitGlobal         = 600
+	DefaultRateLimitGlobalBurst    = 100
+	DefaultRateLimitKeyId          = 30
+	DefaultRateLimitKeyIdBurst     = 10
+	DefaultRateLimitPrincipal      = 30
+	DefaultRateLimitPrincipalBurst = 10
+
+	CaSlot = "9a"
 )
 
 var (
@@ -18,11 +45,195 @@ var (
 	StaticTestingRoot = ""
 )
 
+type JwtKeyConfig struct {
+	Slot      string   `json:"slot"`
+	Algorithm string   `json:"algorithm"`
+	Issuers   []string `json:"issuers"`
+	Audiences []string `json:"audiences"`
+	MaxExpire int      `json:"max_expire"`
+}
+
+type HostConfig struct {
+	CaFile         string   `json:"ca_file"`
+	Pins           []string `json:"pins"`
+	ClientCertSlot string   `json:"client_cert_slot"`
+	ClientCertFile string   `json:"client_cert_file"`
+	ClientKeyFile  string   `json:"client_key_file"`
+	Proxy          string   `json:"proxy"`
+	Transport      string   `json:"transport"`
+}
+
+type KeyConfig struct {
+	SshAlgorithm string                   `json:"ssh_algorithm"`
+	ResponseSlot string                   `json:"response_slot"`
+	TouchPolicy  string                   `json:"touch_policy"`
+	TouchTimeout int                      `json:"touch_timeout"`
+	JwtKeys      map[string]*JwtKeyConfig `json:"jwt_keys"`
+}
+
+// Returns the slot id for a slot name or an empty string if unknown, the
+// yubikey package can not be used from the config
+func getSlotId(name string) string {
+	switch strings.ToLower(name) {
+	case "9a", "authentication":
+		return "9a"
+	case "9c", "signature":
+		return "9c"
+	case "9d", "key_management":
+		return "9d"
+	case "9e", "card_authentication":
+		return "9e"
+	}
+	return ""
+}
+
+// The CA key and response key must not be used to sign JWTs, a JWT
+// signature from either slot could be presented as a certificate or
+// response signature
+func (k *KeyConfig) Validate(serial string) (err error) {
+	responseSlot := ""
+	if k.ResponseSlot != "" {
+		responseSlot = getSlotId(k.ResponseSlot)
+		if responseSlot == "" {
+			err = &errortypes.ParseError{
+				errors.Newf("config: Key '%s' response_slot '%s' is "+
+					"invalid", serial, k.ResponseSlot),
+			}
+			return
+		}
+
+		if responseSlot == CaSlot {
+			err = &errortypes.ParseError{
+				errors.Newf("config: Key '%s' response_slot can not be "+
+					"the CA slot", serial),
+			}
+			return
+		}
+	}
+
+	for alias, jwtKey := range k.JwtKeys {
+		if jwtKey == nil {
+			err = &errortypes.ParseError{
+				errors.Newf("config: Key '%s' JWT key '%s' is empty",
+					serial, alias),
+			}
+			return
+		}
+
+		slot := getSlotId(jwtKey.Slot)
+		if slot == "" {
+			err = &errortypes.ParseError{
+				errors.Newf("config: Key '%s' JWT key '%s' slot '%s' is "+
+					"invalid", serial, alias, jwtKey.Slot),
+			}
+			return
+		}
+
+		if slot == CaSlot {
+			err = &errortypes.ParseError{
+				errors.Newf("config: Key '%s' JWT key '%s' can not use "+
+					"the CA slot", serial, alias),
+			}
+			return
+		}
+
+		if slot == responseSlot {
+			err = &errortypes.ParseError{
+				errors.Newf("config: Key '%s' JWT key '%s' can not use "+
+					"the response slot", serial, alias),
+			}
+			return
+		}
+	}
+
+	return
+}
+
 type ConfigData struct {
-	path                 string   `json:"-"`
-	loaded               bool     `json:"-"`
-	MaxCertificateExpire int      `json:"max_certificate_expire"`
-	PritunlZeroHosts     []string `json:"pritunl_zero_hosts"`
+	path                    string                 `json:"-"`
+	loaded                  bool                   `json:"-"`
+	deniedKeys              map[string]bool        `json:"-"`
+	MaxCertificateExpire    int                    `json:"max_certificate_expire"`
+	MinCertificateExpire    int                    `json:"min_certificate_expire"`
+	CertificateBackdate     int                    `json:"certificate_backdate"`
+	MaxCertificateSkew      int                    `json:"max_certificate_skew"`
+	RateLimitGlobal         int                    `json:"rate_limit_global"`
+	RateLimitGlobalBurst    int                    `json:"rate_limit_global_burst"`
+	RateLimitKeyId          int                    `json:"rate_limit_key_id"`
+	RateLimitKeyIdBurst     int                    `json:"rate_limit_key_id_burst"`
+	RateLimitPrincipal      int                    `json:"rate_limit_principal"`
+	RateLimitPrincipalBurst int                    `json:"rate_limit_principal_burst"`
+	MinPayloadVersion       int                    `json:"min_payload_version"`
+	AllowPayloadV1          bool                   `json:"allow_payload_v1"`
+	ReplayWindow            int                    `json:"replay_window"`
+	ReplayCacheSize         int                    `json:"replay_cache_size"`
+	ApprovalPrincipals      []string               `json:"approval_principals"`
+	ApprovalTimeout         int                    `json:"approval_timeout"`
+	MaxBatchSize            int                    `json:"max_batch_size"`
+	MinRsaBits              int                    `json:"min_rsa_bits"`
+	RequireSkVerify         bool                   `json:"require_sk_verify"`
+	AllowEmptyPrincipals    bool                   `json:"allow_empty_principals"`
+	DeniedKeys              []string               `json:"denied_keys"`
+	WorkerCount             int                    `json:"worker_count"`
+	WorkerQueueSize         int                    `json:"worker_queue_size"`
+	ShutdownTimeout         int                    `json:"shutdown_timeout"`
+	ZeroHosts               []*ZeroHostConfig      `json:"zero_hosts"`
+	PritunlZeroHosts        []string               `json:"pritunl_zero_hosts"`
+	PritunlZeroHostGroups   [][]string             `json:"pritunl_zero_host_groups"`
+	Hosts                   map[string]*HostConfig `json:"hosts"`
+	Keys                    map[string]*KeyConfig  `json:"keys"`
+}
+
+func (c *ConfigData) GetKey(serial string) (key *KeyConfig) {
+	key = c.Keys[serial]
+	if key == nil {
+		key = &KeyConfig{}
+	}
+
+	return
+}
+
+func (c *ConfigData) GetHost(host string) (hostConf *HostConfig) {
+	hostConf = c.Hosts[host]
+	if hostConf == nil {
+		hostConf = &HostConfig{}
+	}
+
+	return
+}
+
+// Denied keys are parsed when the config is loaded so an invalid entry
+// fails startup instead of every sign request
+func (c *ConfigData) parseDeniedKeys() (err error) {
+	c.deniedKeys = map[string]bool{}
+
+	for i, entry := range c.DeniedKeys {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if strings.HasPrefix(entry, "SHA256:") {
+			c.deniedKeys[entry] = true
+			continue
+		}
+
+		deniedKey, _, _, _, e := ssh.ParseAuthorizedKey([]byte(entry))
+		if e != nil {
+			err = &errortypes.ParseError{
+				errors.Wrapf(e, "config: Failed to parse denied key %d", i),
+			}
+			return
+		}
+
+		c.deniedKeys[ssh.FingerprintSHA256(deniedKey)] = true
+	}
+
+	return
+}
+
+func (c *ConfigData) IsDeniedKey(pubKey ssh.PublicKey) bool {
+	return c.deniedKeys[ssh.FingerprintSHA256(pubKey)]
 }
 
 func (c *ConfigData) Save() (err error) {
@@ -71,6 +282,22 @@ func Load() (err error) {
 		return
 	}
 
+	err = data.parseDeniedKeys()
+	if err != nil {
+		return
+	}
+
+	for serial, keyConf := range data.Keys {
+		if keyConf == nil {
+			continue
+		}
+
+		err = keyConf.Validate(serial)
+		if err != nil {
+			return
+		}
+	}
+
 	data.loaded = true
 
 	Config = data
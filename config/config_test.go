@@ -0,0 +1,74 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"golang.org/x/crypto/ssh"
+	"testing"
+)
+
+func newTestSshKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error! Failed to generate key: %s", err)
+	}
+
+	pubKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Error! Failed to parse key: %s", err)
+	}
+
+	return pubKey
+}
+
+func TestParseDeniedKeys(t *testing.T) {
+	authorizedKey := newTestSshKey(t)
+	fingerprintKey := newTestSshKey(t)
+	otherKey := newTestSshKey(t)
+
+	conf := &ConfigData{
+		DeniedKeys: []string{
+			"",
+			"  ",
+			string(ssh.MarshalAuthorizedKey(authorizedKey)),
+			" " + ssh.FingerprintSHA256(fingerprintKey) + " ",
+		},
+	}
+
+	err := conf.parseDeniedKeys()
+	if err != nil {
+		t.Fatalf("Error! Failed to parse denied keys: %s", err)
+	}
+
+	if !conf.IsDeniedKey(authorizedKey) {
+		t.Fatal("Error! Authorized key entry not denied")
+	}
+
+	if !conf.IsDeniedKey(fingerprintKey) {
+		t.Fatal("Error! Fingerprint entry not denied")
+	}
+
+	if conf.IsDeniedKey(otherKey) {
+		t.Fatal("Error! Denied key not in config")
+	}
+}
+
+func TestParseDeniedKeysInvalid(t *testing.T) {
+	for _, entry := range []string{
+		"ssh-ed25519",
+		"ssh-rsa invalid",
+		"not a key",
+	} {
+		conf := &ConfigData{
+			DeniedKeys: []string{entry},
+		}
+
+		err := conf.parseDeniedKeys()
+		if err == nil {
+			t.Fatalf("Error! Accepted invalid denied key '%s'", entry)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	DefaultZeroPath = "/hsm"
+
+	TransportAuto      = "auto"
+	TransportWebsocket = "websocket"
+	TransportPolling   = "polling"
+)
+
+// Pritunl Zero host, the secret is only referenced by file or environment
+// variable so it is never stored in the config
+type ZeroHostConfig struct {
+	Group      string `json:"group"`
+	Host       string `json:"host"`
+	Path       string `json:"path"`
+	Serial     string `json:"serial"`
+	Token      string `json:"token"`
+	SecretFile string `json:"secret_file"`
+	SecretEnv  string `json:"secret_env"`
+	HostConfig
+}
+
+func (h *ZeroHostConfig) GetPath() string {
+	if h.Path == "" {
+		return DefaultZeroPath
+	}
+	return h.Path
+}
+
+func (h *ZeroHostConfig) Validate() (err error) {
+	if h.Host == "" {
+		err = &errortypes.ParseError{
+			errors.New("config: Zero host missing host"),
+		}
+		return
+	}
+
+	if strings.Contains(h.Host, "/") || strings.Contains(h.Host, "@") {
+		err = &errortypes.ParseError{
+			errors.Newf("config: Zero host '%s' must be a host name "+
+				"and optional port", h.Host),
+		}
+		return
+	}
+
+	if h.Path != "" && !strings.HasPrefix(h.Path, "/") {
+		err = &errortypes.ParseError{
+			errors.Newf("config: Zero host '%s' path must start with '/'",
+				h.Host),
+		}
+		return
+	}
+
+	if h.Serial == "" {
+		err = &errortypes.ParseError{
+			errors.Newf("config: Zero host '%s' missing serial", h.Host),
+		}
+		return
+	}
+
+	if h.Token == "" {
+		err = &errortypes.ParseError{
+			errors.Newf("config: Zero host '%s' missing token", h.Host),
+		}
+		return
+	}
+
+	if (h.SecretFile == "") == (h.SecretEnv == "") {
+		err = &errortypes.ParseError{
+			errors.Newf("config: Zero host '%s' requires one of "+
+				"secret_file or secret_env", h.Host),
+		}
+		return
+	}
+
+	if (h.ClientCertFile == "") != (h.ClientKeyFile == "") {
+		err = &errortypes.ParseError{
+			errors.Newf("config: Zero host '%s' requires both "+
+				"client_cert_file and client_key_file", h.Host),
+		}
+		return
+	}
+
+	if h.ClientCertFile != "" && h.ClientCertSlot != "" {
+		err = &errortypes.ParseError{
+			errors.Newf("config: Zero host '%s' can not set both "+
+				"client_cert_file and client_cert_slot", h.Host),
+		}
+		return
+	}
+
+	switch h.Transport {
+	case "", TransportAuto, TransportWebsocket, TransportPolling:
+		break
+	default:
+		err = &errortypes.ParseError{
+			errors.Newf("config: Zero host '%s' transport '%s' is invalid",
+				h.Host, h.Transport),
+		}
+		return
+	}
+
+	if h.Proxy != "" {
+		proxyUrl, e := url.Parse(h.Proxy)
+		if e != nil || proxyUrl.Host == "" {
+			err = &errortypes.ParseError{
+				errors.Newf("config: Zero host '%s' proxy is invalid",
+					h.Host),
+			}
+			return
+		}
+
+		switch proxyUrl.Scheme {
+		case "http", "socks5":
+			break
+		default:
+			err = &errortypes.ParseError{
+				errors.Newf("config: Zero host '%s' proxy scheme '%s' "+
+					"is unsupported", h.Host, proxyUrl.Scheme),
+			}
+			return
+		}
+	}
+
+	return
+}
+
+func (h *ZeroHostConfig) GetSecret() (secret string, err error) {
+	if h.SecretEnv != "" {
+		secret = os.Getenv(h.SecretEnv)
+		if secret == "" {
+			err = &errortypes.ReadError{
+				errors.Newf("config: Zero host '%s' secret environment "+
+					"variable '%s' is empty", h.Host, h.SecretEnv),
+			}
+			return
+		}
+		return
+	}
+
+	data, err := ioutil.ReadFile(h.SecretFile)
+	if err != nil {
+		err = &errortypes.ReadError{
+			errors.Wrapf(err, "config: Zero host '%s' failed to read "+
+				"secret file", h.Host),
+		}
+		return
+	}
+
+	secret = strings.TrimSpace(string(data))
+	if secret == "" {
+		err = &errortypes.ReadError{
+			errors.Newf("config: Zero host '%s' secret file is empty",
+				h.Host),
+		}
+		return
+	}
+
+	return
+}
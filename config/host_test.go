@@ -0,0 +1,135 @@
+package config
+
+import (
+	"testing"
+)
+
+func newTestHost() *ZeroHostConfig {
+	return &ZeroHostConfig{
+		Host:      "zero.example.com",
+		Serial:    "12345678",
+		Token:     "token",
+		SecretEnv: "HSM_SECRET",
+	}
+}
+
+func TestZeroHostValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(host *ZeroHostConfig)
+		valid  bool
+	}{
+		{"valid", func(host *ZeroHostConfig) {}, true},
+		{"host_port", func(host *ZeroHostConfig) {
+			host.Host = "zero.example.com:8443"
+		}, true},
+		{"host_missing", func(host *ZeroHostConfig) {
+			host.Host = ""
+		}, false},
+		{"host_url", func(host *ZeroHostConfig) {
+			host.Host = "https://zero.example.com"
+		}, false},
+		{"host_path", func(host *ZeroHostConfig) {
+			host.Host = "zero.example.com/hsm"
+		}, false},
+		{"host_user", func(host *ZeroHostConfig) {
+			host.Host = "user@zero.example.com"
+		}, false},
+		{"path", func(host *ZeroHostConfig) {
+			host.Path = "/custom"
+		}, true},
+		{"path_relative", func(host *ZeroHostConfig) {
+			host.Path = "custom"
+		}, false},
+		{"serial_missing", func(host *ZeroHostConfig) {
+			host.Serial = ""
+		}, false},
+		{"token_missing", func(host *ZeroHostConfig) {
+			host.Token = ""
+		}, false},
+		{"secret_file", func(host *ZeroHostConfig) {
+			host.SecretEnv = ""
+			host.SecretFile = "/etc/pritunl-hsm/secret"
+		}, true},
+		{"secret_missing", func(host *ZeroHostConfig) {
+			host.SecretEnv = ""
+		}, false},
+		{"secret_both", func(host *ZeroHostConfig) {
+			host.SecretFile = "/etc/pritunl-hsm/secret"
+		}, false},
+		{"client_cert_file", func(host *ZeroHostConfig) {
+			host.ClientCertFile = "/etc/pritunl-hsm/client.crt"
+			host.ClientKeyFile = "/etc/pritunl-hsm/client.key"
+		}, true},
+		{"client_cert_missing_key", func(host *ZeroHostConfig) {
+			host.ClientCertFile = "/etc/pritunl-hsm/client.crt"
+		}, false},
+		{"client_key_missing_cert", func(host *ZeroHostConfig) {
+			host.ClientKeyFile = "/etc/pritunl-hsm/client.key"
+		}, false},
+		{"client_cert_slot", func(host *ZeroHostConfig) {
+			host.ClientCertSlot = "9d"
+		}, true},
+		{"client_cert_file_and_slot", func(host *ZeroHostConfig) {
+			host.ClientCertFile = "/etc/pritunl-hsm/client.crt"
+			host.ClientKeyFile = "/etc/pritunl-hsm/client.key"
+			host.ClientCertSlot = "9d"
+		}, false},
+		{"transport_auto", func(host *ZeroHostConfig) {
+			host.Transport = TransportAuto
+		}, true},
+		{"transport_websocket", func(host *ZeroHostConfig) {
+			host.Transport = TransportWebsocket
+		}, true},
+		{"transport_polling", func(host *ZeroHostConfig) {
+			host.Transport = TransportPolling
+		}, true},
+		{"transport_invalid", func(host *ZeroHostConfig) {
+			host.Transport = "udp"
+		}, false},
+		{"proxy_http", func(host *ZeroHostConfig) {
+			host.Proxy = "http://proxy.example.com:3128"
+		}, true},
+		{"proxy_socks5", func(host *ZeroHostConfig) {
+			host.Proxy = "socks5://proxy.example.com:1080"
+		}, true},
+		{"proxy_https", func(host *ZeroHostConfig) {
+			host.Proxy = "https://proxy.example.com:3128"
+		}, false},
+		{"proxy_socks4", func(host *ZeroHostConfig) {
+			host.Proxy = "socks4://proxy.example.com:1080"
+		}, false},
+		{"proxy_invalid", func(host *ZeroHostConfig) {
+			host.Proxy = "proxy.example.com:3128"
+		}, false},
+		{"proxy_missing_host", func(host *ZeroHostConfig) {
+			host.Proxy = "http://"
+		}, false},
+	}
+
+	for _, test := range tests {
+		host := newTestHost()
+		test.modify(host)
+
+		err := host.Validate()
+		if test.valid && err != nil {
+			t.Fatalf("Error! Test %s rejected valid host: %s",
+				test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("Error! Test %s accepted invalid host", test.name)
+		}
+	}
+}
+
+func TestZeroHostGetPath(t *testing.T) {
+	host := newTestHost()
+	if host.GetPath() != DefaultZeroPath {
+		t.Fatal("Error! Default path not used")
+	}
+
+	host.Path = "/custom"
+	if host.GetPath() != "/custom" {
+		t.Fatal("Error! Custom path not used")
+	}
+}
@@ -5,8 +5,5 @@ const (
 	ConfPath = "/etc/pritunl-hsm.json"
 	LogPath  = "/var/log/pritunl-hsm.log"
 	LogPath2 = "/var/log/pritunl-hsm.log.1"
-)
-
-var (
-	Interrupt = false
+	SockPath = "/var/run/pritunl-hsm.sock"
 )
@@ -40,6 +40,34 @@ type RequestError struct {
 	errors.DropboxError
 }
 
+type PolicyError struct {
+	errors.DropboxError
+}
+
+type RateLimitError struct {
+	errors.DropboxError
+}
+
+type TimeoutError struct {
+	errors.DropboxError
+}
+
+type DeviceError struct {
+	errors.DropboxError
+}
+
+type UnavailableError struct {
+	errors.DropboxError
+}
+
+type DuplicateError struct {
+	errors.DropboxError
+}
+
+type ExpiredError struct {
+	errors.DropboxError
+}
+
 type ErrorData struct {
 	Error   string `json:"error"`
 	Message string `json:"error_msg"`
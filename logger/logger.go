@@ -1,8 +1,8 @@
 package logger
 
 import (
+	"context"
 	"github.com/Sirupsen/logrus"
-	"github.com/pritunl/pritunl-hsm/constants"
 	"os"
 	"strings"
 )
@@ -12,16 +12,17 @@ var (
 	senders = []sender{}
 )
 
-func initSender() {
+func initSender(ctx context.Context) {
 	for _, sndr := range senders {
 		sndr.Init()
 	}
 
 	go func() {
 		for {
-			entry := <-buffer
-
-			if constants.Interrupt {
+			var entry *logrus.Entry
+			select {
+			case entry = <-buffer:
+			case <-ctx.Done():
 				return
 			}
 
@@ -36,11 +37,11 @@ func initSender() {
 	}()
 }
 
-func Init() {
+func Init(ctx context.Context) {
 	logrus.SetFormatter(&formatter{})
 	logrus.AddHook(&logHook{})
 	logrus.SetOutput(os.Stderr)
 	logrus.SetLevel(logrus.InfoLevel)
 
-	initSender()
+	initSender(ctx)
 }
@@ -1,44 +1,70 @@
 package main
 
 import (
-	"github.com/Sirupsen/logrus"
-	"github.com/pritunl/pritunl-hsm/config"
-	"github.com/pritunl/pritunl-hsm/constants"
-	"github.com/pritunl/pritunl-hsm/logger"
-	"github.com/pritunl/pritunl-hsm/socket"
-	"github.com/pritunl/pritunl-hsm/yubikey"
+	"flag"
+	"fmt"
+	"github.com/pritunl/pritunl-hsm/cmd"
 	"os"
-	"os/signal"
-	"syscall"
-	"time"
 )
 
+const help = `
+Usage: pritunl-hsm COMMAND
+
+Commands:
+  start              Start HSM service
+  approvals          List certificate requests pending approval
+  approve <id>       Approve pending certificate request
+  deny <id>          Deny pending certificate request
+  sockets            Show Pritunl Zero connection state
+  export-user-ca     Print CA keys for sshd TrustedUserCAKeys
+  export-host-ca [patterns]
+                     Print CA keys as known_hosts @cert-authority lines
+  fingerprint        Print CA key SHA256 and MD5 fingerprints
+`
+
 func main() {
-	err := config.Init()
-	if err != nil {
-		panic(err)
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, help)
 	}
+	flag.Parse()
 
-	logger.Init()
+	var err error
 
-	err = yubikey.Init()
-	if err != nil {
-		panic(err)
-	}
+	switch flag.Arg(0) {
+	case "", "start":
+		err = cmd.Service()
+		if err != nil {
+			panic(err)
+		}
+		return
+	case "approvals":
+		err = cmd.Approvals()
+	case "approve", "deny":
+		if flag.Arg(1) == "" {
+			flag.Usage()
+			os.Exit(1)
+		}
 
-	logrus.Info("main: Starting sockets")
+		if flag.Arg(0) == "approve" {
+			err = cmd.Approve(flag.Arg(1))
+		} else {
+			err = cmd.Deny(flag.Arg(1))
+		}
+	case "sockets":
+		err = cmd.Sockets()
+	case "export-user-ca":
+		err = cmd.ExportUserCa()
+	case "export-host-ca":
+		err = cmd.ExportHostCa(flag.Arg(1))
+	case "fingerprint":
+		err = cmd.Fingerprint()
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	err = socket.Init()
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-
-	sig := make(chan os.Signal, 2)
-	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
-	<-sig
-
-	constants.Interrupt = true
-
-	logrus.Info("main: Shutting down")
-	time.Sleep(300 * time.Millisecond)
 }
@@ -0,0 +1,67 @@
+package socket
+
+import (
+	"github.com/gorilla/websocket"
+	"time"
+)
+
+// Message transport for a single connection. Messages are read by one
+// reader goroutine and written by the connection writer.
+type conn interface {
+	ReadMessage() (message []byte, err error)
+	WriteJSON(v interface{}) (err error)
+	Ping() (err error)
+	Shutdown()
+	Close() (err error)
+	Transport() string
+}
+
+type wsConn struct {
+	sock *Socket
+	conn *websocket.Conn
+}
+
+func (c *wsConn) ReadMessage() (message []byte, err error) {
+	_, message, err = c.conn.ReadMessage()
+	if err != nil {
+		return
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(pingWait))
+
+	return
+}
+
+func (c *wsConn) WriteJSON(v interface{}) (err error) {
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	err = c.conn.WriteJSON(v)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (c *wsConn) Ping() (err error) {
+	err = c.sock.ping(c.conn)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (c *wsConn) Shutdown() {
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+		time.Now().Add(writeTimeout))
+}
+
+func (c *wsConn) Close() (err error) {
+	err = c.conn.Close()
+	return
+}
+
+func (c *wsConn) Transport() string {
+	return "websocket"
+}
@@ -5,8 +5,30 @@ import (
 )
 
 const (
-	writeTimeout   = 10 * time.Second
-	statusInterval = 30 * time.Second
-	pingInterval   = 30 * time.Second
-	pingWait       = 40 * time.Second
+	writeTimeout       = 10 * time.Second
+	handshakeTimeout   = 45 * time.Second
+	statusInterval     = 30 * time.Second
+	pingInterval       = 30 * time.Second
+	pingWait           = 40 * time.Second
+	heartbeatInterval  = 30 * time.Second
+	heartbeatMaxMissed = 3
+	maxMessageSize     = 1048576
+	backoffMin         = 1 * time.Second
+	backoffMax         = 5 * time.Minute
+	stableDuration     = 60 * time.Second
+	failbackInterval   = 30 * time.Second
+	requestWindow      = 10 * time.Minute
+	requestCacheSize   = 4096
+	rejectQueueSize    = 64
+	pollPath           = "/poll"
+	pollWait           = 25 * time.Second
+)
+
+var (
+	messageTypes = []string{
+		"ssh_certificate",
+		"ssh_certificate_batch",
+		"jwt_sign",
+		"heartbeat",
+	}
 )
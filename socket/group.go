@@ -0,0 +1,219 @@
+package socket
+
+import (
+	"context"
+	"github.com/Sirupsen/logrus"
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"sync"
+	"time"
+)
+
+type requestEntry struct {
+	id        string
+	timestamp time.Time
+}
+
+// Ordered list of Zero hosts for one HSM, the first socket is the primary
+// and the rest are backups used only while the primary is unreachable
+type Group struct {
+	Sockets []*Socket
+	lock    sync.Mutex
+	seen    map[string]bool
+	queue   []requestEntry
+}
+
+func NewGroup(socks []*Socket) (group *Group) {
+	group = &Group{
+		Sockets: socks,
+		seen:    map[string]bool{},
+	}
+
+	for _, sock := range socks {
+		sock.group = group
+	}
+
+	return
+}
+
+// Records the request id, returns false if the request was already
+// received on any socket in the group
+func (g *Group) claim(id string) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	now := time.Now()
+
+	i := 0
+	for ; i < len(g.queue); i++ {
+		if now.Sub(g.queue[i].timestamp) <= requestWindow &&
+			len(g.queue)-i <= requestCacheSize {
+
+			break
+		}
+		delete(g.seen, g.queue[i].id)
+	}
+	g.queue = g.queue[i:]
+
+	if g.seen[id] {
+		return false
+	}
+
+	g.seen[id] = true
+	g.queue = append(g.queue, requestEntry{
+		id:        id,
+		timestamp: now,
+	})
+
+	return true
+}
+
+// Request ids are never released, a request retried on another socket
+// after its response was lost receives a duplicate error and is not signed
+// again
+func (g *Group) checkRequest(id string) (err error) {
+	if !g.claim(id) {
+		err = &errortypes.DuplicateError{
+			errors.New("socket: Request already received"),
+		}
+		return
+	}
+
+	return
+}
+
+// Connects to the first reachable socket in priority order
+func (g *Group) connect() (sock *Socket, c conn, err error) {
+	for _, s := range g.Sockets {
+		cn, e := s.dial()
+		if e != nil {
+			s.setError(e)
+			err = e
+
+			if len(g.Sockets) > 1 {
+				logrus.WithFields(logrus.Fields{
+					"host":  s.Host,
+					"error": e,
+				}).Warn("socket: Failed to connect to Pritunl Zero host")
+			}
+			continue
+		}
+
+		sock = s
+		c = cn
+		err = nil
+		return
+	}
+
+	return
+}
+
+// Periodically dials the primary while connected to a backup, once the
+// primary is reachable the backup is closed and the primary connection
+// is returned. The channel is closed when the probe exits.
+func (g *Group) probe(ctx context.Context, cancel context.CancelFunc,
+	primary chan conn) {
+
+	defer close(primary)
+
+	ticker := time.NewTicker(failbackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c, err := g.Sockets[0].dial()
+			if err != nil {
+				g.Sockets[0].setError(err)
+				continue
+			}
+
+			logrus.WithFields(logrus.Fields{
+				"host": g.Sockets[0].Host,
+			}).Info("socket: Primary Pritunl Zero host recovered")
+
+			primary <- c
+			cancel()
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (g *Group) serve(ctx context.Context, sock *Socket,
+	c conn) (err error) {
+
+	if sock == g.Sockets[0] {
+		err = sock.serve(ctx, c)
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"host":    sock.Host,
+		"primary": g.Sockets[0].Host,
+	}).Warn("socket: Failing over to backup Pritunl Zero host")
+
+	backupCtx, cancel := context.WithCancel(ctx)
+	primary := make(chan conn, 1)
+
+	go g.probe(backupCtx, cancel, primary)
+
+	err = sock.serve(backupCtx, c)
+	cancel()
+	sock.setConnected(false)
+
+	// Wait for the probe to exit, a dial in progress may still connect to
+	// the primary and the connection must be used or closed
+	primaryConn, ok := <-primary
+	if ok {
+		if ctx.Err() != nil {
+			primaryConn.Close()
+			return
+		}
+		err = g.Sockets[0].serve(ctx, primaryConn)
+	}
+
+	return
+}
+
+func (g *Group) Run(ctx context.Context) {
+	running.Add(1)
+	defer running.Done()
+
+	primary := g.Sockets[0]
+
+	for {
+		start := time.Now()
+
+		sock, c, err := g.connect()
+		if err == nil {
+			err = g.serve(ctx, sock, c)
+			sock.setConnected(false)
+			primary.setConnected(false)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		stable := time.Since(start) >= stableDuration
+		delay := primary.nextBackoff(err, stable)
+
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"host":  primary.Host,
+				"retry": delay.String(),
+				"error": err,
+			}).Error("socket: Socket stream error")
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package socket
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-hsm/authority"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"time"
+)
+
+func (s *Socket) touchPending(sess *session,
+	payload *authority.HsmPayload) func(timeout time.Duration) {
+
+	return func(timeout time.Duration) {
+		pending, err := authority.GetTouchPendingPayload(
+			payload.Version, payload.Id, s.Token, s.Secret,
+			s.Serial, timeout)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("socket: Marshal touch pending payload error")
+			return
+		}
+
+		s.trySend(sess, pending)
+	}
+}
+
+// Builds the response for errors the requester can act on, other errors
+// return nil and are reported with an error payload
+func (s *Socket) signResponse(sess *session,
+	payload *authority.HsmPayload, cert []byte, err error) (
+	resp *authority.SshResponse) {
+
+	resp = &authority.SshResponse{}
+
+	switch signErr := err.(type) {
+	case nil:
+		resp.Certificate = cert
+		return
+	case *errortypes.TimeoutError:
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("socket: Sign request touch timed out")
+	case *errortypes.PolicyError:
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Warn("socket: Sign request denied by policy")
+	case *errortypes.RateLimitError:
+		logrus.WithFields(logrus.Fields{
+			"host":  s.Host,
+			"error": err,
+		}).Error("socket: Alert certificate issue rate limit exceeded")
+
+		alert, e := authority.GetAlertPayload(
+			payload.Version, s.Token, s.Secret,
+			"rate_limit", signErr.GetMessage())
+		if e != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": e,
+			}).Error("socket: Marshal alert payload error")
+		} else {
+			s.send(sess, alert)
+		}
+	default:
+		resp = nil
+		return
+	}
+
+	resp.Error, resp.ErrorMsg = authority.GetErrorClass(err)
+
+	return
+}
+
+func (s *Socket) handleSshCertificate(sess *session,
+	payload *authority.HsmPayload, data []byte) (err error) {
+
+	sshReq := &authority.SshRequest{}
+
+	err = json.Unmarshal(data, sshReq)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "socket: Failed to unmarshal payload data"),
+		}
+		return
+	}
+
+	cert, e := authority.Sign(s.Serial, sshReq, payload.GetDeadline(),
+		s.touchPending(sess, payload))
+
+	respData := s.signResponse(sess, payload, cert, e)
+	if respData == nil {
+		err = e
+		return
+	}
+
+	resp, err := authority.MarshalPayload(payload.Version, payload.Id,
+		s.Token, s.Secret, "ssh_certificate", respData)
+	if err != nil {
+		return
+	}
+
+	s.send(sess, resp)
+
+	return
+}
+
+func (s *Socket) handleSshCertificateBatch(sess *session,
+	payload *authority.HsmPayload, data []byte) (err error) {
+
+	batchReq := &authority.SshBatchRequest{}
+
+	err = json.Unmarshal(data, batchReq)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "socket: Failed to unmarshal payload data"),
+		}
+		return
+	}
+
+	results, e := authority.SignBatch(s.Serial, batchReq,
+		payload.GetDeadline(), s.touchPending(sess, payload))
+
+	respData := &authority.SshBatchResponse{
+		Results: []*authority.SshResponse{},
+	}
+
+	if e != nil {
+		// Batch rejected as a whole, report the error for every item
+		itemResp := s.signResponse(sess, payload, nil, e)
+		if itemResp == nil {
+			err = e
+			return
+		}
+
+		for range batchReq.Requests {
+			respData.Results = append(respData.Results, itemResp)
+		}
+	} else {
+		for _, result := range results {
+			itemResp := s.signResponse(sess, payload,
+				result.Certificate, result.Error)
+			if itemResp == nil {
+				logrus.WithFields(logrus.Fields{
+					"error": result.Error,
+				}).Error("socket: Sign batch item error")
+
+				itemResp = &authority.SshResponse{}
+				itemResp.Error, itemResp.ErrorMsg =
+					authority.GetErrorClass(result.Error)
+			}
+			respData.Results = append(respData.Results, itemResp)
+		}
+	}
+
+	resp, err := authority.MarshalPayload(payload.Version, payload.Id,
+		s.Token, s.Secret, "ssh_certificate_batch", respData)
+	if err != nil {
+		return
+	}
+
+	s.send(sess, resp)
+
+	return
+}
+
+func (s *Socket) handleJwtSign(sess *session,
+	payload *authority.HsmPayload, data []byte) (err error) {
+
+	jwtReq := &authority.JwtRequest{}
+
+	err = json.Unmarshal(data, jwtReq)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "socket: Failed to unmarshal payload data"),
+		}
+		return
+	}
+
+	token, e := authority.SignJwt(s.Serial, jwtReq, payload.GetDeadline(),
+		s.touchPending(sess, payload))
+
+	signResp := s.signResponse(sess, payload, nil, e)
+	if signResp == nil {
+		err = e
+		return
+	}
+
+	respData := &authority.JwtResponse{
+		Token:    token,
+		Error:    signResp.Error,
+		ErrorMsg: signResp.ErrorMsg,
+	}
+
+	resp, err := authority.MarshalPayload(payload.Version, payload.Id,
+		s.Token, s.Secret, "jwt_sign", respData)
+	if err != nil {
+		return
+	}
+
+	s.send(sess, resp)
+
+	return
+}
+
+func (s *Socket) sendError(sess *session,
+	version int, id, typ string, err error) {
+
+	if id == "" {
+		return
+	}
+
+	payload, e := authority.GetErrorPayload(
+		version, id, s.Token, s.Secret, typ, err)
+	if e != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": e,
+		}).Error("socket: Marshal error payload error")
+		return
+	}
+
+	s.send(sess, payload)
+}
+
+// Only the id and type are read from the unauthenticated message to allow
+// the request to fail without waiting
+func (s *Socket) rejectMessage(sess *session, message []byte, err error) {
+	header := &authority.HsmPayload{}
+	if json.Unmarshal(message, header) == nil {
+		s.sendError(sess, s.getVersion(), header.Id, header.Type, err)
+	}
+}
+
+func (s *Socket) handleMessage(sess *session, message []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": errors.New(fmt.Sprintf("%s", r)),
+			}).Error("socket: Message handle error")
+		}
+	}()
+
+	payload, data, err := authority.UnmarshalPayload(
+		s.Token, s.Secret, s.getVersion(), message)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("socket: Unmarshal payload error")
+
+		s.rejectMessage(sess, message, err)
+		return
+	}
+
+	s.setVersion(payload.Version)
+
+	if data == nil {
+		return
+	}
+
+	if s.group != nil {
+		err = s.group.checkRequest(payload.Id)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"host": s.Host,
+				"id":   payload.Id,
+			}).Warn("socket: Ignoring duplicate request")
+
+			s.sendError(sess, payload.Version, payload.Id,
+				payload.Type, err)
+			return
+		}
+	}
+
+	err = authority.CheckDeadline(payload)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"type": payload.Type,
+			"id":   payload.Id,
+		}).Warn("socket: Dropping expired request")
+
+		s.sendError(sess, payload.Version, payload.Id, payload.Type, err)
+		return
+	}
+
+	switch payload.Type {
+	case "ssh_certificate":
+		err = s.handleSshCertificate(sess, payload, data)
+	case "ssh_certificate_batch":
+		err = s.handleSshCertificateBatch(sess, payload, data)
+	case "jwt_sign":
+		err = s.handleJwtSign(sess, payload, data)
+	case "heartbeat":
+		err = s.handleHeartbeat(sess, payload, data)
+	default:
+		err = &errortypes.NotFoundError{
+			errors.Newf("socket: Unknown payload type '%s'", payload.Type),
+		}
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"type":  payload.Type,
+			"error": err,
+		}).Error("socket: Handle payload error")
+
+		authority.SetLastError(err)
+		s.sendError(sess, payload.Version, payload.Id, payload.Type, err)
+		return
+	}
+}
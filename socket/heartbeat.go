@@ -0,0 +1,179 @@
+package socket
+
+import (
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"github.com/dropbox/godropbox/errors"
+	"github.com/gorilla/websocket"
+	"github.com/pritunl/pritunl-hsm/authority"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+type heartbeatState struct {
+	pingSent         time.Time
+	pingLatency      time.Duration
+	heartbeatId      string
+	heartbeatSent    time.Time
+	heartbeatLatency time.Duration
+	missedHeartbeats int
+}
+
+// Sets the initial read deadline, each pong or message extends it. A
+// connection that stops responding fails the next read.
+func (s *Socket) initDeadline(conn *websocket.Conn) {
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(pingWait))
+	conn.SetPongHandler(func(string) error {
+		now := time.Now()
+
+		s.lock.Lock()
+		if !s.heartbeat.pingSent.IsZero() {
+			s.heartbeat.pingLatency = now.Sub(s.heartbeat.pingSent)
+		}
+		s.lock.Unlock()
+
+		conn.SetReadDeadline(now.Add(pingWait))
+		return nil
+	})
+}
+
+func (s *Socket) ping(conn *websocket.Conn) (err error) {
+	s.lock.Lock()
+	s.heartbeat.pingSent = time.Now()
+	s.lock.Unlock()
+
+	err = conn.WriteControl(websocket.PingMessage, []byte{},
+		time.Now().Add(writeTimeout))
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// Starts a new heartbeat, returns an error if too many heartbeats have
+// gone unanswered. Heartbeats are only sent once Zero has advertised
+// support, otherwise the connection relies on ping and pong.
+func (s *Socket) nextHeartbeat() (id string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.heartbeats {
+		return
+	}
+
+	if s.heartbeat.heartbeatId != "" {
+		s.heartbeat.missedHeartbeats += 1
+
+		if s.heartbeat.missedHeartbeats >= heartbeatMaxMissed {
+			err = &errortypes.TimeoutError{
+				errors.New("socket: Heartbeat response timed out"),
+			}
+			return
+		}
+	}
+
+	id = bson.NewObjectId().Hex()
+	s.heartbeat.heartbeatId = id
+	s.heartbeat.heartbeatSent = time.Now()
+
+	return
+}
+
+// Records the response to the pending heartbeat, returns false if the id
+// does not match
+func (s *Socket) recordHeartbeat(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if id == "" || id != s.heartbeat.heartbeatId {
+		return false
+	}
+
+	s.heartbeat.heartbeatLatency = time.Since(s.heartbeat.heartbeatSent)
+	s.heartbeat.heartbeatId = ""
+	s.heartbeat.missedHeartbeats = 0
+
+	return true
+}
+
+// Handles a heartbeat response on the reader, returns false if the message
+// is not a response to the pending heartbeat
+func (s *Socket) ackHeartbeat(message []byte) bool {
+	header := &authority.HsmPayload{}
+	if json.Unmarshal(message, header) != nil ||
+		header.Type != "heartbeat" {
+
+		return false
+	}
+
+	s.lock.Lock()
+	pending := s.heartbeat.heartbeatId
+	s.lock.Unlock()
+
+	if pending == "" || header.Id != pending {
+		return false
+	}
+
+	payload, _, err := authority.UnmarshalPayload(
+		s.Token, s.Secret, s.getVersion(), message)
+	if err != nil {
+		return false
+	}
+
+	s.setVersion(payload.Version)
+
+	return s.recordHeartbeat(payload.Id)
+}
+
+func (s *Socket) sendHeartbeat(sess *session, id string) {
+	payload, err := authority.MarshalPayload(s.getVersion(), id,
+		s.Token, s.Secret, "heartbeat", &authority.Heartbeat{
+			Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("socket: Marshal heartbeat payload error")
+		return
+	}
+
+	s.send(sess, payload)
+}
+
+// Records the response to a heartbeat sent by the agent, heartbeats
+// started by Zero are echoed back
+func (s *Socket) handleHeartbeat(sess *session,
+	payload *authority.HsmPayload, data []byte) (err error) {
+
+	if s.recordHeartbeat(payload.Id) {
+		return
+	}
+
+	// Heartbeats sent by Zero show support for heartbeat responses
+	s.lock.Lock()
+	s.heartbeats = true
+	s.lock.Unlock()
+
+	heartbeat := &authority.Heartbeat{}
+
+	err = json.Unmarshal(data, heartbeat)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "socket: Failed to unmarshal payload data"),
+		}
+		return
+	}
+
+	resp, err := authority.MarshalPayload(payload.Version, payload.Id,
+		s.Token, s.Secret, "heartbeat", heartbeat)
+	if err != nil {
+		return
+	}
+
+	s.send(sess, resp)
+
+	return
+}
@@ -0,0 +1,250 @@
+package socket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"github.com/pritunl/pritunl-hsm/utils"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HTTPS long-polling transport for networks that break websockets. Zero
+// holds each GET to the poll path open until requests are available or
+// the wait expires, responses are sent as separate POST requests. Each
+// request is signed with the same headers as the websocket handshake.
+type pollConn struct {
+	sock      *Socket
+	session   string
+	client    *http.Client
+	transport *http.Transport
+	ctx       context.Context
+	cancel    context.CancelFunc
+	pending   []json.RawMessage
+}
+
+func (s *Socket) dialPolling() (c *pollConn, err error) {
+	tlsConf, err := s.getTlsConfig()
+	if err != nil {
+		return
+	}
+
+	proxy, err := s.getProxy()
+	if err != nil {
+		return
+	}
+
+	session, err := utils.RandStr(32)
+	if err != nil {
+		return
+	}
+
+	transport := &http.Transport{
+		Proxy:               proxy,
+		TLSClientConfig:     tlsConf,
+		TLSHandshakeTimeout: handshakeTimeout,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c = &pollConn{
+		sock:      s,
+		session:   session,
+		client:    &http.Client{Transport: transport},
+		transport: transport,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+
+	reqCtx, reqCancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer reqCancel()
+
+	resp, err := c.request(reqCtx, "GET", 0, nil)
+	if err != nil {
+		c.Close()
+		c = nil
+		return
+	}
+	defer resp.Body.Close()
+
+	c.pending, err = readPollMessages(resp)
+	if err != nil {
+		c.Close()
+		c = nil
+		return
+	}
+
+	s.negotiate(resp)
+
+	return
+}
+
+func readPollMessages(resp *http.Response) (
+	messages []json.RawMessage, err error) {
+
+	if resp.StatusCode == http.StatusNoContent {
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+	if err != nil {
+		err = &errortypes.RequestError{
+			errors.Wrap(err, "socket: Failed to read poll response"),
+		}
+		return
+	}
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		return
+	}
+
+	err = json.Unmarshal(body, &messages)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "socket: Failed to parse poll response"),
+		}
+		return
+	}
+
+	return
+}
+
+func (c *pollConn) request(ctx context.Context, method string,
+	wait time.Duration, body []byte) (resp *http.Response, err error) {
+
+	path := c.sock.Path + pollPath
+
+	header, err := c.sock.getSig(method, path)
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequest(method,
+		fmt.Sprintf("https://%s%s", c.sock.Host, path),
+		bytes.NewReader(body))
+	if err != nil {
+		err = &errortypes.RequestError{
+			errors.Wrap(err, "socket: Failed to create poll request"),
+		}
+		return
+	}
+	req = req.WithContext(ctx)
+
+	req.Header = header
+	req.Header.Set("Hsm-Session", c.session)
+	if method == "GET" {
+		req.Header.Set("Hsm-Poll-Wait",
+			strconv.Itoa(int(wait/time.Second)))
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err = c.client.Do(req)
+	if err != nil {
+		err = &errortypes.RequestError{
+			errors.Wrap(err, "socket: Poll request failed"),
+		}
+		return
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			err = &errortypes.AuthenticationError{
+				errors.Newf("socket: Poll request unauthorized (%d)",
+					resp.StatusCode),
+			}
+		default:
+			err = &errortypes.RequestError{
+				errors.Newf("socket: Poll request bad status (%d)",
+					resp.StatusCode),
+			}
+		}
+		resp = nil
+		return
+	}
+
+	return
+}
+
+// Returns the next buffered message, polling Zero until one is available.
+// A poll that fails to return within the wait ends the connection.
+func (c *pollConn) ReadMessage() (message []byte, err error) {
+	for len(c.pending) == 0 {
+		ctx, cancel := context.WithTimeout(c.ctx, pollWait+writeTimeout)
+		resp, e := c.request(ctx, "GET", pollWait, nil)
+		if e != nil {
+			cancel()
+			err = e
+			return
+		}
+
+		c.pending, err = readPollMessages(resp)
+		resp.Body.Close()
+		cancel()
+		if err != nil {
+			return
+		}
+	}
+
+	message = c.pending[0]
+	c.pending = c.pending[1:]
+
+	return
+}
+
+func (c *pollConn) WriteJSON(v interface{}) (err error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "socket: Failed to marshal poll message"),
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, writeTimeout)
+	defer cancel()
+
+	resp, err := c.request(ctx, "POST", 0, body)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+
+	return
+}
+
+// Each poll confirms the connection is alive, there is no separate ping
+func (c *pollConn) Ping() (err error) {
+	return
+}
+
+func (c *pollConn) Shutdown() {
+	ctx, cancel := context.WithTimeout(c.ctx, writeTimeout)
+	defer cancel()
+
+	resp, err := c.request(ctx, "DELETE", 0, nil)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
+
+func (c *pollConn) Close() (err error) {
+	c.cancel()
+	c.transport.CloseIdleConnections()
+	return
+}
+
+func (c *pollConn) Transport() string {
+	return "polling"
+}
@@ -0,0 +1,102 @@
+package socket
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/pritunl/pritunl-hsm/config"
+	"sync"
+	"time"
+)
+
+var (
+	draining  = make(chan struct{})
+	drainOnce = sync.Once{}
+	drainLock = sync.Mutex{}
+	inflight  = sync.WaitGroup{}
+	running   = sync.WaitGroup{}
+)
+
+func isDraining() bool {
+	select {
+	case <-draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// Adds an in-flight request, returns false once draining has started. The
+// drain lock prevents a request from being added after Drain has started
+// waiting.
+func startRequest() bool {
+	drainLock.Lock()
+	defer drainLock.Unlock()
+
+	if isDraining() {
+		return false
+	}
+	inflight.Add(1)
+
+	return true
+}
+
+func getWorkerCount() int {
+	count := config.Config.WorkerCount
+	if count == 0 {
+		count = config.DefaultWorkerCount
+	}
+	return count
+}
+
+func getWorkerQueueSize() int {
+	size := config.Config.WorkerQueueSize
+	if size == 0 {
+		size = config.DefaultWorkerQueueSize
+	}
+	return size
+}
+
+func wait(group *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Stops accepting new requests and waits for in-flight requests to finish
+// and queue their responses
+func Drain() {
+	timeout := config.Config.ShutdownTimeout
+	if timeout == 0 {
+		timeout = config.DefaultShutdownTimeout
+	}
+
+	drainLock.Lock()
+	drainOnce.Do(func() {
+		close(draining)
+	})
+	drainLock.Unlock()
+
+	if !wait(&inflight, time.Duration(timeout)*time.Second) {
+		logrus.WithFields(logrus.Fields{
+			"timeout": timeout,
+		}).Warn("socket: Timed out waiting for in-flight requests")
+	}
+}
+
+// Waits for sockets to close after the context passed to Init is cancelled
+func Wait() {
+	if !wait(&running, writeTimeout) {
+		logrus.Warn("socket: Timed out waiting for sockets to close")
+	}
+}
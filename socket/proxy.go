@@ -0,0 +1,50 @@
+package socket
+
+import (
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"net/http"
+	"net/url"
+)
+
+// Returns the proxy function for the host, a configured proxy takes
+// priority over the HTTPS_PROXY and NO_PROXY environment variables
+func (s *Socket) getProxy() (
+	proxy func(*http.Request) (*url.URL, error), err error) {
+
+	proxyUri := s.Options.Proxy
+	if proxyUri == "" {
+		proxy = http.ProxyFromEnvironment
+		return
+	}
+
+	proxyUrl, err := url.Parse(proxyUri)
+	if err != nil {
+		err = &errortypes.ParseError{
+			errors.Wrap(err, "socket: Failed to parse proxy url"),
+		}
+		return
+	}
+
+	switch proxyUrl.Scheme {
+	case "http", "socks5":
+		break
+	default:
+		err = &errortypes.ParseError{
+			errors.Newf("socket: Unsupported proxy scheme '%s'",
+				proxyUrl.Scheme),
+		}
+		return
+	}
+
+	if proxyUrl.Host == "" {
+		err = &errortypes.ParseError{
+			errors.New("socket: Proxy url missing host"),
+		}
+		return
+	}
+
+	proxy = http.ProxyURL(proxyUrl)
+
+	return
+}
@@ -0,0 +1,90 @@
+package socket
+
+import (
+	"context"
+	"github.com/Sirupsen/logrus"
+	"github.com/pritunl/pritunl-hsm/authority"
+)
+
+type rejection struct {
+	message []byte
+	err     error
+}
+
+// State for a single connection, the queue is owned by the connection
+// writer and is valid until the context is done
+type session struct {
+	ctx     context.Context
+	queue   chan *authority.HsmPayload
+	rejects chan rejection
+}
+
+// Queues a rejected message without blocking the reader, rejections are
+// dropped when the reject queue is full
+func (s *Socket) reject(sess *session, message []byte, err error) {
+	select {
+	case sess.rejects <- rejection{
+		message: message,
+		err:     err,
+	}:
+	default:
+		logrus.WithFields(logrus.Fields{
+			"host":  s.Host,
+			"error": err,
+		}).Warn("socket: Reject queue full, dropping message")
+	}
+}
+
+func (s *Socket) rejecter(sess *session) {
+	for {
+		select {
+		case rej := <-sess.rejects:
+			s.rejectMessage(sess, rej.message, rej.err)
+		case <-sess.ctx.Done():
+			return
+		}
+	}
+}
+
+// A payload that fails to sign is sent without the device signature so
+// the request is answered instead of waiting for a timeout
+func (s *Socket) signPayload(payload *authority.HsmPayload) {
+	err := authority.SignPayload(s.Serial, payload)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"host":  s.Host,
+			"id":    payload.Id,
+			"type":  payload.Type,
+			"error": err,
+		}).Error("socket: Sign response payload error, sending unsigned")
+	}
+}
+
+// Queues the payload without waiting, used while holding the key lock
+func (s *Socket) trySend(sess *session, payload *authority.HsmPayload) {
+	s.signPayload(payload)
+
+	select {
+	case sess.queue <- payload:
+	default:
+		logrus.WithFields(logrus.Fields{
+			"host": s.Host,
+			"id":   payload.Id,
+			"type": payload.Type,
+		}).Warn("socket: Send queue full, dropping payload")
+	}
+}
+
+func (s *Socket) send(sess *session, payload *authority.HsmPayload) {
+	s.signPayload(payload)
+
+	select {
+	case sess.queue <- payload:
+	case <-sess.ctx.Done():
+		logrus.WithFields(logrus.Fields{
+			"host": s.Host,
+			"id":   payload.Id,
+			"type": payload.Type,
+		}).Warn("socket: Connection closed, dropping payload")
+	}
+}
@@ -1,31 +1,66 @@
 package socket
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha512"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"github.com/Sirupsen/logrus"
 	"github.com/dropbox/godropbox/errors"
 	"github.com/gorilla/websocket"
 	"github.com/pritunl/pritunl-hsm/authority"
+	"github.com/pritunl/pritunl-hsm/config"
+	"github.com/pritunl/pritunl-hsm/constants"
 	"github.com/pritunl/pritunl-hsm/errortypes"
 	"github.com/pritunl/pritunl-hsm/utils"
+	"math/rand"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Socket struct {
-	Serial string
-	Token  string
-	Secret string
-	Host   string
+	Serial        string
+	Token         string
+	Secret        string
+	Host          string
+	Path          string
+	Options       *config.HostConfig
+	version       int
+	connected     bool
+	connects      uint64
+	attempts      int
+	backoff       time.Duration
+	nextRetry     time.Time
+	lastError     error
+	lastErrorTime time.Time
+	transport     string
+	heartbeats    bool
+	heartbeat     heartbeatState
+	group         *Group
+	lock          sync.Mutex
 }
 
-func (s *Socket) getSig() (header http.Header, err error) {
+func (s *Socket) getVersion() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.version
+}
+
+func (s *Socket) setVersion(version int) {
+	s.lock.Lock()
+	if version > s.version && version <= authority.PayloadVersion {
+		s.version = version
+	}
+	s.lock.Unlock()
+}
+
+func (s *Socket) getSig(method, path string) (
+	header http.Header, err error) {
+
 	header = http.Header{}
 
 	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
@@ -39,8 +74,8 @@ func (s *Socket) getSig() (header http.Header, err error) {
 		s.Token,
 		timestamp,
 		nonce,
-		"GET",
-		"/hsm",
+		method,
+		path,
 	}, "&")
 
 	hashFunc := hmac.New(sha512.New, []byte(s.Secret))
@@ -53,151 +88,408 @@ func (s *Socket) getSig() (header http.Header, err error) {
 	header.Add("Auth-Timestamp", timestamp)
 	header.Add("Auth-Nonce", nonce)
 
+	payloadVersions := []string{}
+	for _, version := range authority.PayloadVersions {
+		payloadVersions = append(payloadVersions, strconv.Itoa(version))
+	}
+
+	header.Add("Hsm-Agent-Version", constants.Version)
+	header.Add("Hsm-Protocol-Version",
+		strconv.Itoa(authority.PayloadVersion))
+	header.Add("Hsm-Payload-Versions", strings.Join(payloadVersions, ","))
+	header.Add("Hsm-Capabilities", strings.Join(messageTypes, ","))
+
+	return
+}
+
+func (s *Socket) getTransport() string {
+	if s.Options == nil || s.Options.Transport == "" {
+		return config.TransportAuto
+	}
+	return s.Options.Transport
+}
+
+// Connects with the configured transport, in auto mode long-polling is
+// used when Zero is reachable but the websocket upgrade fails
+func (s *Socket) dial() (c conn, err error) {
+	switch s.getTransport() {
+	case config.TransportWebsocket:
+		c, _, err = s.dialWebsocket()
+		return
+	case config.TransportPolling:
+		pc, e := s.dialPolling()
+		if e != nil {
+			err = e
+			return
+		}
+		c = pc
+		return
+	case config.TransportAuto:
+		break
+	default:
+		err = &errortypes.ParseError{
+			errors.Newf("socket: Unknown transport '%s'", s.getTransport()),
+		}
+		return
+	}
+
+	c, upgradeFailed, err := s.dialWebsocket()
+	if err == nil || !upgradeFailed {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"host":  s.Host,
+		"error": err,
+	}).Warn("socket: Websocket upgrade failed, trying long-polling")
+
+	pc, e := s.dialPolling()
+	if e != nil {
+		err = e
+		return
+	}
+	c = pc
+	err = nil
+
+	return
+}
+
+// Zero may select a protocol version in the response, otherwise the
+// version is raised as payloads are received
+func getResponseVersion(resp *http.Response) (version int) {
+	version = authority.PayloadVersion1
+	if resp == nil {
+		return
+	}
+
+	serverVersion, e := strconv.Atoi(resp.Header.Get("Hsm-Protocol-Version"))
+	if e == nil && serverVersion > version {
+		version = serverVersion
+		if version > authority.PayloadVersion {
+			version = authority.PayloadVersion
+		}
+	}
+
 	return
 }
 
-func (s *Socket) stream() (err error) {
-	header, err := s.getSig()
+// Sets the protocol version and features advertised by Zero in the
+// handshake response
+func (s *Socket) negotiate(resp *http.Response) {
+	version := getResponseVersion(resp)
+
+	heartbeats := false
+	if resp != nil {
+		for _, typ := range strings.Split(
+			resp.Header.Get("Hsm-Capabilities"), ",") {
+
+			if strings.TrimSpace(typ) == "heartbeat" {
+				heartbeats = true
+			}
+		}
+	}
+
+	s.lock.Lock()
+	s.version = version
+	s.heartbeats = heartbeats
+	s.lock.Unlock()
+}
+
+func (s *Socket) dialWebsocket() (c conn, upgradeFailed bool, err error) {
+	header, err := s.getSig("GET", s.Path)
 	if err != nil {
 		return
 	}
 
-	conn, _, err := websocket.DefaultDialer.Dial(
-		fmt.Sprintf("wss://%s/hsm", s.Host), header)
+	tlsConf, err := s.getTlsConfig()
+	if err != nil {
+		return
+	}
+
+	proxy, err := s.getProxy()
+	if err != nil {
+		return
+	}
+
+	dialer := &websocket.Dialer{
+		Proxy:            proxy,
+		HandshakeTimeout: handshakeTimeout,
+		TLSClientConfig:  tlsConf,
+	}
+
+	wconn, resp, err := dialer.Dial(
+		fmt.Sprintf("wss://%s%s", s.Host, s.Path), header)
 	if err != nil {
+		// A response without an upgrade means Zero was reached but the
+		// websocket was rejected, possibly by a middlebox
+		upgradeFailed = err == websocket.ErrBadHandshake && resp != nil
 		err = &errortypes.ParseError{
 			errors.Wrap(err, "authority: Failed to connect to pritunl host"),
 		}
 		return
 	}
-	defer conn.Close()
 
-	logrus.WithFields(logrus.Fields{
-		"host": s.Host,
-	}).Info("socket: Connected to Pritunl Zero host")
+	s.initDeadline(wconn)
 
-	queue := make(chan *authority.HsmPayload, 50)
-	defer close(queue)
+	s.negotiate(resp)
 
-	errChan := make(chan error, 1)
+	c = &wsConn{
+		sock: s,
+		conn: wconn,
+	}
 
-	go func() {
-		defer func() {
-			recover()
-		}()
-		for {
-			_, message, e := conn.ReadMessage()
-			if e != nil {
-				errChan <- e
-				return
-			}
+	return
+}
 
-			go func() {
-				if r := recover(); r != nil {
-					logrus.WithFields(logrus.Fields{
-						"error": errors.New(fmt.Sprintf("%s", r)),
-					}).Error("socket: Message handle error")
-				}
+// Reads messages and passes them to the workers. The reader is the only
+// sender on the jobs channel and closes it when the connection ends.
+func (s *Socket) read(sess *session, c conn,
+	jobs chan []byte, errChan chan error) {
 
-				msgId, msgType, data, e := authority.UnmarshalPayload(
-					s.Token, s.Secret, message)
-				if e != nil {
-					logrus.WithFields(logrus.Fields{
-						"error": e,
-					}).Error("socket: Unmarshal payload error")
-					return
-				}
+	defer close(jobs)
 
-				if msgType == "ssh_certificate" && data != nil {
-					sshReq := &authority.SshRequest{}
+	for {
+		message, err := c.ReadMessage()
+		if err != nil {
+			errChan <- err
+			return
+		}
 
-					err = json.Unmarshal(data, sshReq)
-					if err != nil {
-						err = &errortypes.ParseError{
-							errors.Wrap(err,
-								"socket: Failed to unmarshal payload data"),
-						}
-						return
-					}
+		// Heartbeat responses are matched before the worker queue so
+		// they are never delayed by device operations
+		if s.ackHeartbeat(message) {
+			continue
+		}
 
-					cert, e := authority.Sign(s.Serial, sshReq)
-					if e != nil {
-						logrus.WithFields(logrus.Fields{
-							"error": e,
-						}).Error("socket: Sign payload error")
-						return
-					}
+		if !startRequest() {
+			s.reject(sess, message, &errortypes.UnavailableError{
+				errors.New("socket: Service shutting down"),
+			})
+			continue
+		}
 
-					data := &authority.SshResponse{
-						Certificate: cert,
-					}
+		select {
+		case jobs <- message:
+		default:
+			inflight.Done()
+			s.reject(sess, message, &errortypes.UnavailableError{
+				errors.New("socket: Worker queue full"),
+			})
+		}
+	}
+}
 
-					resp, e := authority.MarshalPayload(msgId, s.Token,
-						s.Secret, "ssh_certificate", data)
-					if e != nil {
-						logrus.WithFields(logrus.Fields{
-							"error": e,
-						}).Error("socket: Marshal payload error")
-						return
-					}
+func (s *Socket) work(sess *session, jobs chan []byte) {
+	for message := range jobs {
+		s.handleMessage(sess, message)
+		inflight.Done()
+	}
+}
 
-					queue <- resp
-				}
-			}()
+func (s *Socket) status(sess *session) {
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			payload, err := authority.GetStatusPayload(
+				s.getVersion(), s.Token, s.Secret, s.Serial,
+				getConnectionStatus(s.Serial))
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error": err,
+				}).Error("socket: Marshal status payload error")
+				continue
+			}
+
+			s.send(sess, payload)
+		case <-sess.ctx.Done():
+			return
 		}
-	}()
+	}
+}
+
+func (s *Socket) capabilities(sess *session) {
+	payload, err := authority.GetCapabilitiesPayload(
+		s.getVersion(), s.Token, s.Secret, s.Serial, messageTypes)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("socket: Marshal capabilities payload error")
+		return
+	}
+
+	s.send(sess, payload)
+}
+
+// Runs a single connection. The calling goroutine is the only writer to
+// the connection and the queue is never closed, senders stop once the
+// session context is done. Cancelling the parent context flushes queued
+// responses and closes the connection.
+func (s *Socket) serve(ctx context.Context, c conn) (err error) {
+	defer c.Close()
+
+	s.lock.Lock()
+	s.connected = true
+	s.connects += 1
+	s.transport = c.Transport()
+	s.heartbeat = heartbeatState{}
+	s.lock.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"host":      s.Host,
+		"transport": c.Transport(),
+	}).Info("socket: Connected to Pritunl Zero host")
+
+	sessCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sess := &session{
+		ctx:     sessCtx,
+		queue:   make(chan *authority.HsmPayload, 50),
+		rejects: make(chan rejection, rejectQueueSize),
+	}
+
+	jobs := make(chan []byte, getWorkerQueueSize())
+	errChan := make(chan error, 1)
+
+	for i := 0; i < getWorkerCount(); i++ {
+		go s.work(sess, jobs)
+	}
+	go s.read(sess, c, jobs, errChan)
+	go s.status(sess)
+	go s.capabilities(sess)
+	go s.rejecter(sess)
 
 	ticker := time.NewTicker(pingInterval)
 	defer ticker.Stop()
 
-	statusTicker := time.NewTicker(statusInterval)
-	defer statusTicker.Stop()
+	heartbeatTicker := time.NewTicker(heartbeatInterval)
+	defer heartbeatTicker.Stop()
 
 	for {
 		select {
-		case msg, ok := <-queue:
-			if !ok {
-				conn.WriteControl(websocket.CloseMessage, []byte{},
-					time.Now().Add(writeTimeout))
-				return
-			}
-
-			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
-			err = conn.WriteJSON(msg)
+		case msg := <-sess.queue:
+			err = c.WriteJSON(msg)
 			if err != nil {
 				return
 			}
 		case <-ticker.C:
-			err = conn.WriteControl(websocket.PingMessage, []byte{},
-				time.Now().Add(writeTimeout))
+			err = c.Ping()
 			if err != nil {
 				return
 			}
-		case <-statusTicker.C:
-			payload, e := authority.GetStatusPayload(
-				s.Token, s.Secret, s.Serial)
+		case <-heartbeatTicker.C:
+			id, e := s.nextHeartbeat()
 			if e != nil {
 				err = e
 				return
 			}
 
-			queue <- payload
+			if id != "" {
+				go s.sendHeartbeat(sess, id)
+			}
 		case e := <-errChan:
 			err = e
 			return
+		case <-ctx.Done():
+		flush:
+			for {
+				select {
+				case msg := <-sess.queue:
+					err = c.WriteJSON(msg)
+					if err != nil {
+						return
+					}
+				default:
+					break flush
+				}
+			}
+
+			c.Shutdown()
+			return
 		}
 	}
 }
 
-func (s *Socket) Run() {
-	for {
-		err := s.stream()
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"error": err,
-			}).Error("socket: Socket stream error")
+func (s *Socket) setConnected(connected bool) {
+	s.lock.Lock()
+	s.connected = connected
+	s.lock.Unlock()
+}
+
+// Returns the next reconnect delay, the delay doubles with each failed
+// attempt up to the max and is randomized between half and the full delay
+// to spread out reconnects across agents
+func (s *Socket) nextBackoff(err error, stable bool) (delay time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if stable {
+		s.attempts = 0
+	}
+
+	delay = backoffMin << uint(s.attempts)
+	if delay > backoffMax || delay <= 0 {
+		delay = backoffMax
+	} else {
+		s.attempts += 1
+	}
+
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+
+	s.backoff = delay
+	s.nextRetry = time.Now().Add(delay)
+	if err != nil {
+		authority.SetLastError(err)
+		s.lastError = err
+		s.lastErrorTime = time.Now()
+	}
+
+	return
+}
+
+func (s *Socket) setError(err error) {
+	authority.SetLastError(err)
+
+	s.lock.Lock()
+	s.lastError = err
+	s.lastErrorTime = time.Now()
+	s.lock.Unlock()
+}
+
+func (s *Socket) Status() (status *SocketStatus) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	status = &SocketStatus{
+		Host:      s.Host,
+		Serial:    s.Serial,
+		Connected: s.connected,
+		Connects:  s.connects,
+		Attempts:  s.attempts,
+		Transport: s.transport,
+	}
+
+	if !s.connected {
+		status.Backoff = int64(s.backoff / time.Second)
+		if !s.nextRetry.IsZero() {
+			status.NextRetry = s.nextRetry.Unix()
 		}
+	}
 
-		time.Sleep(1 * time.Second)
+	if s.connected {
+		status.Latency = int64(s.heartbeat.pingLatency / time.Millisecond)
+		status.HeartbeatLatency = int64(
+			s.heartbeat.heartbeatLatency / time.Millisecond)
+		status.MissedHeartbeats = s.heartbeat.missedHeartbeats
 	}
+
+	if s.lastError != nil {
+		status.LastError = s.lastError.Error()
+		status.LastErrorTime = s.lastErrorTime.Unix()
+	}
+
+	return
 }
@@ -0,0 +1,63 @@
+package socket
+
+import (
+	"github.com/pritunl/pritunl-hsm/authority"
+	"sync"
+)
+
+var (
+	sockets     = []*Socket{}
+	socketsLock = sync.Mutex{}
+)
+
+type SocketStatus struct {
+	Host             string `json:"host"`
+	Serial           string `json:"serial"`
+	Connected        bool   `json:"connected"`
+	Connects         uint64 `json:"connects"`
+	Attempts         int    `json:"attempts"`
+	Transport        string `json:"transport"`
+	Latency          int64  `json:"latency"`
+	HeartbeatLatency int64  `json:"heartbeat_latency"`
+	MissedHeartbeats int    `json:"missed_heartbeats"`
+	Backoff          int64  `json:"backoff"`
+	NextRetry        int64  `json:"next_retry"`
+	LastError        string `json:"last_error"`
+	LastErrorTime    int64  `json:"last_error_time"`
+}
+
+func GetStatus() (statuses []*SocketStatus) {
+	statuses = []*SocketStatus{}
+
+	socketsLock.Lock()
+	for _, sock := range sockets {
+		statuses = append(statuses, sock.Status())
+	}
+	socketsLock.Unlock()
+
+	return
+}
+
+func getConnectionStatus(serial string) (status *authority.ConnectionStatus) {
+	status = &authority.ConnectionStatus{}
+
+	socketsLock.Lock()
+	for _, sock := range sockets {
+		if sock.Serial != serial {
+			continue
+		}
+
+		sockStatus := sock.Status()
+		status.Hosts += 1
+		if sockStatus.Connected {
+			status.Connected += 1
+			status.Latency = sockStatus.Latency
+			status.HeartbeatLatency = sockStatus.HeartbeatLatency
+			status.MissedHeartbeats = sockStatus.MissedHeartbeats
+		}
+		status.Connects += sockStatus.Connects
+	}
+	socketsLock.Unlock()
+
+	return
+}
@@ -0,0 +1,167 @@
+package socket
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"github.com/dropbox/godropbox/errors"
+	"github.com/pritunl/pritunl-hsm/config"
+	"github.com/pritunl/pritunl-hsm/errortypes"
+	"github.com/pritunl/pritunl-hsm/ykpiv"
+	"github.com/pritunl/pritunl-hsm/yubikey"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Holds the key lock for handshake signatures made with a PIV slot
+type pivSigner struct {
+	serial string
+	slot   *ykpiv.Slot
+}
+
+func (p *pivSigner) Public() crypto.PublicKey {
+	return p.slot.Public()
+}
+
+func (p *pivSigner) Sign(rand io.Reader, digest []byte,
+	opts crypto.SignerOpts) (sig []byte, err error) {
+
+	yubikey.LockKey(p.serial)
+	defer yubikey.UnlockKey(p.serial)
+
+	sig, err = p.slot.Sign(rand, digest, opts)
+	return
+}
+
+func getSpkiPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// Pins are only matched against the verified chains, the raw certificates
+// are sent by the server and may include any certificate
+func verifyPins(pins []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, verifiedChains [][]*x509.Certificate) (
+		err error) {
+
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				certPin := getSpkiPin(cert)
+				for _, pin := range pins {
+					if strings.TrimPrefix(pin, "sha256/") == certPin {
+						return
+					}
+				}
+			}
+		}
+
+		err = &errortypes.AuthenticationError{
+			errors.New("socket: Server certificate does not match pin"),
+		}
+		return
+	}
+}
+
+func (s *Socket) getClientCert(hostConf *config.HostConfig) (
+	cert *tls.Certificate, err error) {
+
+	if hostConf.ClientCertSlot != "" {
+		slotId, e := yubikey.ParseSlot(hostConf.ClientCertSlot)
+		if e != nil {
+			err = e
+			return
+		}
+
+		yubi := yubikey.GetKey(s.Serial)
+		if yubi == nil {
+			err = &errortypes.NotFoundError{
+				errors.New("socket: Failed to find hsm"),
+			}
+			return
+		}
+
+		yubikey.LockKey(s.Serial)
+		slot, e := yubi.Slot(slotId)
+		yubikey.UnlockKey(s.Serial)
+		if e != nil {
+			err = e
+			return
+		}
+
+		if slot.Certificate == nil {
+			err = &errortypes.NotFoundError{
+				errors.New("socket: Client certificate slot is empty"),
+			}
+			return
+		}
+
+		tlsCert := slot.TLSCertificate()
+		tlsCert.PrivateKey = &pivSigner{
+			serial: s.Serial,
+			slot:   slot,
+		}
+		cert = &tlsCert
+
+		return
+	}
+
+	if hostConf.ClientCertFile != "" {
+		tlsCert, e := tls.LoadX509KeyPair(
+			hostConf.ClientCertFile, hostConf.ClientKeyFile)
+		if e != nil {
+			err = &errortypes.ReadError{
+				errors.Wrap(e, "socket: Failed to load client certificate"),
+			}
+			return
+		}
+		cert = &tlsCert
+	}
+
+	return
+}
+
+func (s *Socket) getTlsConfig() (tlsConf *tls.Config, err error) {
+	hostConf := s.Options
+
+	tlsConf = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if hostConf.CaFile != "" {
+		caData, e := ioutil.ReadFile(hostConf.CaFile)
+		if e != nil {
+			err = &errortypes.ReadError{
+				errors.Wrap(e, "socket: Failed to read CA bundle"),
+			}
+			return
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			err = &errortypes.ParseError{
+				errors.New("socket: Failed to parse CA bundle"),
+			}
+			return
+		}
+
+		tlsConf.RootCAs = pool
+	}
+
+	if len(hostConf.Pins) > 0 {
+		tlsConf.VerifyPeerCertificate = verifyPins(hostConf.Pins)
+	}
+
+	cert, err := s.getClientCert(hostConf)
+	if err != nil {
+		return
+	}
+
+	if cert != nil {
+		tlsConf.Certificates = []tls.Certificate{*cert}
+	}
+
+	return
+}
@@ -0,0 +1,83 @@
+package socket
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newTestCert(t *testing.T, name string, isCa bool,
+	parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (
+	cert *x509.Certificate, key *ecdsa.PrivateKey) {
+
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error! Failed to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCa,
+		BasicConstraintsValid: true,
+	}
+	if isCa {
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent,
+		&key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Error! Failed to create certificate: %s", err)
+	}
+
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Error! Failed to parse certificate: %s", err)
+	}
+
+	return
+}
+
+func TestVerifyPins(t *testing.T) {
+	ca, caKey := newTestCert(t, "ca", true, nil, nil)
+	leaf, _ := newTestCert(t, "zero.example.com", false, ca, caKey)
+	pinned, _ := newTestCert(t, "pinned.example.com", false, nil, nil)
+
+	rawCerts := [][]byte{leaf.Raw, ca.Raw}
+	chains := [][]*x509.Certificate{{leaf, ca}}
+
+	err := verifyPins([]string{getSpkiPin(leaf)})(rawCerts, chains)
+	if err != nil {
+		t.Fatalf("Error! Rejected pinned leaf: %s", err)
+	}
+
+	err = verifyPins([]string{"sha256/" + getSpkiPin(ca)})(
+		rawCerts, chains)
+	if err != nil {
+		t.Fatalf("Error! Rejected pinned CA: %s", err)
+	}
+
+	// A pinned certificate appended by the server is not in the verified
+	// chain and must not satisfy the pin
+	appended := [][]byte{leaf.Raw, ca.Raw, pinned.Raw}
+	err = verifyPins([]string{getSpkiPin(pinned)})(appended, chains)
+	if err == nil {
+		t.Fatal("Error! Accepted pin from unverified certificate")
+	}
+}
@@ -1,35 +1,180 @@
 package socket
 
 import (
+	"context"
+	"github.com/Sirupsen/logrus"
+	"github.com/dropbox/godropbox/errors"
 	"github.com/pritunl/pritunl-hsm/config"
+	"github.com/pritunl/pritunl-hsm/errortypes"
 	"net/url"
 	"strings"
 )
 
-func New(uri string) (sock *Socket) {
-	u, err := url.Parse(uri)
-	if err != nil || u.User == nil {
+func New(hostConf *config.ZeroHostConfig) (sock *Socket, err error) {
+	err = hostConf.Validate()
+	if err != nil {
 		return
 	}
 
-	pass, _ := u.User.Password()
+	secret, err := hostConf.GetSecret()
+	if err != nil {
+		return
+	}
+
+	options := hostConf.HostConfig
+
+	sock = &Socket{
+		Serial:  hostConf.Serial,
+		Token:   hostConf.Token,
+		Secret:  secret,
+		Host:    hostConf.Host,
+		Path:    hostConf.GetPath(),
+		Options: &options,
+	}
+
+	return
+}
+
+// Deprecated, parses the token:secret@host/serial uri format
+func NewUri(uri string) (sock *Socket, err error) {
+	// Parse error is not wrapped, it would include the secret
+	u, e := url.Parse(uri)
+	if e != nil {
+		err = &errortypes.ParseError{
+			errors.New("socket: Failed to parse Pritunl Zero host uri"),
+		}
+		return
+	}
+
+	if u.Host == "" {
+		err = &errortypes.ParseError{
+			errors.New("socket: Pritunl Zero host uri missing host"),
+		}
+		return
+	}
+
+	if u.User == nil || u.User.Username() == "" {
+		err = &errortypes.ParseError{
+			errors.Newf("socket: Pritunl Zero host uri for '%s' "+
+				"missing token", u.Host),
+		}
+		return
+	}
+
+	pass, ok := u.User.Password()
+	if !ok || pass == "" {
+		err = &errortypes.ParseError{
+			errors.Newf("socket: Pritunl Zero host uri for '%s' "+
+				"missing secret", u.Host),
+		}
+		return
+	}
+
+	serial := strings.TrimLeft(u.Path, "/")
+	if serial == "" {
+		err = &errortypes.ParseError{
+			errors.Newf("socket: Pritunl Zero host uri for '%s' "+
+				"missing serial", u.Host),
+		}
+		return
+	}
 
 	sock = &Socket{
-		Serial: strings.TrimLeft(u.Path, "/"),
-		Token:  u.User.Username(),
-		Secret: pass,
-		Host:   u.Host,
+		Serial:  serial,
+		Token:   u.User.Username(),
+		Secret:  pass,
+		Host:    u.Host,
+		Path:    config.DefaultZeroPath,
+		Options: config.Config.GetHost(u.Host),
+	}
+
+	return
+}
+
+func newUriGroup(uris []string) (group *Group, err error) {
+	socks := []*Socket{}
+
+	for _, uri := range uris {
+		sock, e := NewUri(uri)
+		if e != nil {
+			err = e
+			return
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"host": sock.Host,
+		}).Warn("socket: Pritunl Zero host uris are deprecated, " +
+			"use zero_hosts")
+
+		socks = append(socks, sock)
 	}
 
+	if len(socks) == 0 {
+		return
+	}
+
+	group = NewGroup(socks)
+
 	return
 }
 
-func Init() (err error) {
+func Init(ctx context.Context) (err error) {
+	groups := []*Group{}
+
 	for _, uri := range config.Config.PritunlZeroHosts {
-		sock := New(uri)
-		if sock != nil {
-			go sock.Run()
+		group, e := newUriGroup([]string{uri})
+		if e != nil {
+			err = e
+			return
+		}
+		if group != nil {
+			groups = append(groups, group)
+		}
+	}
+
+	for _, uris := range config.Config.PritunlZeroHostGroups {
+		group, e := newUriGroup(uris)
+		if e != nil {
+			err = e
+			return
+		}
+		if group != nil {
+			groups = append(groups, group)
+		}
+	}
+
+	// Hosts with the same group name form a failover group in the order
+	// they are configured
+	named := map[string][]*Socket{}
+	names := []string{}
+	for _, hostConf := range config.Config.ZeroHosts {
+		sock, e := New(hostConf)
+		if e != nil {
+			err = e
+			return
+		}
+
+		if hostConf.Group == "" {
+			groups = append(groups, NewGroup([]*Socket{sock}))
+			continue
 		}
+
+		if named[hostConf.Group] == nil {
+			names = append(names, hostConf.Group)
+		}
+		named[hostConf.Group] = append(named[hostConf.Group], sock)
+	}
+
+	for _, name := range names {
+		groups = append(groups, NewGroup(named[name]))
+	}
+
+	for _, group := range groups {
+		socketsLock.Lock()
+		sockets = append(sockets, group.Sockets...)
+		socketsLock.Unlock()
+
+		go group.Run(ctx)
 	}
 
 	return
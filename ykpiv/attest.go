@@ -0,0 +1,99 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paultag@gmail.com>, 2017
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package ykpiv
+
+/*
+#cgo darwin LDFLAGS: -L /usr/local/lib -lykpiv
+#cgo darwin CFLAGS: -I/usr/local/include/ykpiv/
+#cgo linux LDFLAGS: -lykpiv
+#cgo linux CFLAGS: -I/usr/include/ykpiv/
+#include <ykpiv.h>
+*/
+import "C"
+
+import (
+	"fmt"
+
+	"crypto/x509"
+	"encoding/asn1"
+)
+
+// Yubico extension on attestation Certificates holding two bytes, the PIN
+// policy followed by the touch policy of the attested key.
+var policyExtensionId = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 8}
+
+// Attest generates an x509 Certificate for the key in the given slot, signed
+// by the on-chip attestation key. This can be used to prove the key was
+// generated on the device, and will fail for keys that were imported.
+//
+// The attestation Certificate is signed by the intermediate Certificate
+// returned by `AttestationCertificate`, which chains up to the Yubico PIV
+// root CA.
+func (y Yubikey) Attest(id SlotId) (*x509.Certificate, error) {
+	template := []byte{0x00, C.YKPIV_INS_ATTEST, byte(id.Key), 0x00}
+
+	sw, data, err := y.transferData(template, nil, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := getSWError(sw, "transfer_data"); err != nil {
+		return nil, err
+	}
+
+	if sw != C.SW_SUCCESS {
+		return nil, fmt.Errorf("ykpiv: Attest: Unexpected status word: %x", sw)
+	}
+
+	return x509.ParseCertificate(data)
+}
+
+// Get the intermediate attestation x509 Certificate stored on the chip. This
+// is the Certificate that signs the output of `Attest`.
+func (y Yubikey) AttestationCertificate() (*x509.Certificate, error) {
+	return y.GetCertificate(Attestation)
+}
+
+// Get the PIN and touch policies of the key in the given slot. These are read
+// out of the attestation Certificate, so this will fail for keys that were
+// imported rather than generated on the device.
+func (y Yubikey) Policies(id SlotId) (PinPolicy, TouchPolicy, error) {
+	cert, err := y.Attest(id)
+	if err != nil {
+		return PinPolicyNull, TouchPolicyNull, err
+	}
+
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(policyExtensionId) {
+			continue
+		}
+
+		if len(ext.Value) < 2 {
+			return PinPolicyNull, TouchPolicyNull, fmt.Errorf("ykpiv: Policies: Invalid policy extension length")
+		}
+
+		return PinPolicy(ext.Value[0]), TouchPolicy(ext.Value[1]), nil
+	}
+
+	return PinPolicyNull, TouchPolicyNull, fmt.Errorf("ykpiv: Policies: Attestation is missing policy extension")
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,100 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paultag@gmail.com>, 2017
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package pss
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+)
+
+// EMSA-PSS (RFC 8017 9.1.1) encodes a message digest into a block that can
+// be passed through a raw RSA operation to produce an RSASSA-PSS signature.
+// This is needed since the chip only exposes raw RSA, with all padding done
+// on the host.
+
+// Encode the digest `mHash` of hash function `hash` with a salt of `saltLen`
+// random bytes read from `rand`, into a block of `padLen` bytes for a key
+// with a modulus of `modBits` bits.
+func Encode(rand io.Reader, hash crypto.Hash, mHash []byte, saltLen int, modBits int, padLen int) ([]byte, error) {
+	hLen := hash.Size()
+	if len(mHash) != hLen {
+		return nil, fmt.Errorf("ykpiv: pss: Digest length doesn't match hash function")
+	}
+
+	emBits := modBits - 1
+	emLen := (emBits + 7) / 8
+	if emLen < hLen+saltLen+2 || emLen > padLen {
+		return nil, fmt.Errorf("ykpiv: pss: Key size too small for hash and salt")
+	}
+
+	salt := make([]byte, saltLen)
+	if _, err := io.ReadFull(rand, salt); err != nil {
+		return nil, err
+	}
+
+	h := hash.New()
+	h.Write(make([]byte, 8))
+	h.Write(mHash)
+	h.Write(salt)
+	hashed := h.Sum(nil)
+
+	db := make([]byte, emLen-hLen-1)
+	db[emLen-saltLen-hLen-2] = 0x01
+	copy(db[emLen-saltLen-hLen-1:], salt)
+
+	mgf1XOR(db, hash, hashed)
+	db[0] &= 0xff >> uint(8*emLen-emBits)
+
+	em := make([]byte, padLen)
+	offset := padLen - emLen
+	copy(em[offset:], db)
+	copy(em[offset+len(db):], hashed)
+	em[padLen-1] = 0xbc
+
+	return em, nil
+}
+
+// XOR `out` with the MGF1 mask generated from `seed`.
+func mgf1XOR(out []byte, hash crypto.Hash, seed []byte) {
+	counter := make([]byte, 4)
+	done := 0
+	for done < len(out) {
+		h := hash.New()
+		h.Write(seed)
+		h.Write(counter)
+		digest := h.Sum(nil)
+
+		for i := 0; i < len(digest) && done < len(out); i++ {
+			out[done] ^= digest[i]
+			done++
+		}
+
+		for i := 3; i >= 0; i-- {
+			counter[i]++
+			if counter[i] != 0 {
+				break
+			}
+		}
+	}
+}
+
+// vim: foldmethod=marker
@@ -0,0 +1,123 @@
+// {{{ Copyright (c) Paul R. Tagliamonte <paultag@gmail.com>, 2017
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE. }}}
+
+package pss
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"math/big"
+	"testing"
+)
+
+// Salt lengths as resolved by the slot before encoding
+func saltLength(opts *rsa.PSSOptions, hash crypto.Hash, modBits int) int {
+	switch opts.SaltLength {
+	case rsa.PSSSaltLengthAuto:
+		return (modBits-1+7)/8 - 2 - hash.Size()
+	case rsa.PSSSaltLengthEqualsHash:
+		return hash.Size()
+	}
+	return opts.SaltLength
+}
+
+// Applies the raw RSA private key operation, as done by the chip
+func signRaw(key *rsa.PrivateKey, em []byte) []byte {
+	m := new(big.Int).SetBytes(em)
+	s := new(big.Int).Exp(m, key.D, key.N)
+
+	sig := make([]byte, (key.N.BitLen()+7)/8)
+	b := s.Bytes()
+	copy(sig[len(sig)-len(b):], b)
+
+	return sig
+}
+
+func TestEncode(t *testing.T) {
+	for _, bits := range []int{1024, 2048} {
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			t.Fatalf("Error! Failed to generate key: %s", err)
+		}
+
+		for _, hash := range []crypto.Hash{
+			crypto.SHA256,
+			crypto.SHA384,
+			crypto.SHA512,
+		} {
+			for _, opts := range []*rsa.PSSOptions{
+				{SaltLength: rsa.PSSSaltLengthAuto, Hash: hash},
+				{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash},
+			} {
+				h := hash.New()
+				h.Write([]byte("pritunl-hsm"))
+				digest := h.Sum(nil)
+
+				modBits := key.N.BitLen()
+				saltLen := saltLength(opts, hash, modBits)
+
+				// Salt equal to a SHA-512 digest does not fit a 1024
+				// bit key
+				if (modBits+7)/8 < hash.Size()+saltLen+2 {
+					continue
+				}
+
+				em, err := Encode(rand.Reader, hash, digest, saltLen,
+					modBits, bits/8)
+				if err != nil {
+					t.Fatalf("Error! Failed to encode %d %s %d: %s",
+						bits, hash, opts.SaltLength, err)
+				}
+
+				if len(em) != bits/8 {
+					t.Fatalf("Error! Encoded length %d != %d",
+						len(em), bits/8)
+				}
+
+				sig := signRaw(key, em)
+
+				err = rsa.VerifyPSS(&key.PublicKey, hash, digest, sig, opts)
+				if err != nil {
+					t.Fatalf("Error! Failed to verify %d %s %d: %s",
+						bits, hash, opts.SaltLength, err)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeDigestLength(t *testing.T) {
+	_, err := Encode(rand.Reader, crypto.SHA256, make([]byte, 20),
+		32, 2048, 256)
+	if err == nil {
+		t.Fatal("Error! Encoded digest with wrong length")
+	}
+}
+
+func TestEncodeSaltTooLong(t *testing.T) {
+	_, err := Encode(rand.Reader, crypto.SHA512, make([]byte, 64),
+		128, 1024, 128)
+	if err == nil {
+		t.Fatal("Error! Encoded salt longer than key allows")
+	}
+}
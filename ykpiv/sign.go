@@ -36,8 +36,11 @@ import (
 	"unsafe"
 
 	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
 
 	"github.com/pritunl/pritunl-hsm/ykpiv/internal/pkcs1v15"
+	"github.com/pritunl/pritunl-hsm/ykpiv/internal/pss"
 )
 
 // It's never a real party until you import both `unsafe`, *and* `crypto`.
@@ -70,6 +73,8 @@ var hashOIDs = map[crypto.Hash][]byte{
 // favor of the on-chip RNG.
 //
 // The output will be a PKCS#1 v1.5 signature (for RSA) or ECDSA signature (for EC keys) over the digest.
+// Passing *rsa.PSSOptions as `opts` will produce an RSASSA-PSS signature,
+// the salt for which is read from crypto/rand rather than the chip.
 func (s Slot) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
 	algorithm, err := s.getAlgorithm()
 	if err != nil {
@@ -93,16 +98,23 @@ func (s Slot) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte,
 
 func (s Slot) signRsa(digest []byte, opts crypto.SignerOpts, algorithm C.uchar) ([]byte, error) {
 
-	hash := opts.HashFunc()
-	if len(digest) != hash.Size() {
-		return nil, fmt.Errorf("ykpiv: Sign: Digest length doesn't match passed crypto algorithm")
+	if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+		return s.signRsaPss(digest, pssOpts, algorithm)
 	}
 
+	hash := opts.HashFunc()
 	prefix, ok := hashOIDs[hash]
 	if !ok {
 		return nil, fmt.Errorf("ykpiv: Sign: Unsupported algorithm")
 	}
-	digest = append(prefix, digest...)
+
+	if len(digest) != hash.Size() {
+		return nil, fmt.Errorf("ykpiv: Sign: Digest length doesn't match passed crypto algorithm")
+	}
+
+	// Copy the prefix rather than appending to it, the prefixes are shared
+	// between every signing operation.
+	digest = append(append([]byte{}, prefix...), digest...)
 
 	var computedDigest []byte
 	switch algorithm {
@@ -114,6 +126,48 @@ func (s Slot) signRsa(digest []byte, opts crypto.SignerOpts, algorithm C.uchar)
 		return nil, fmt.Errorf("ykpiv: Sign: Can't preform padding for signature, unknown algorithm")
 	}
 
+	return s.signRaw(computedDigest, algorithm)
+}
+
+// RSASSA-PSS signatures are padded on the host, with the salt read from the
+// system RNG, and the padded block passed to the chip for the raw RSA
+// operation.
+func (s Slot) signRsaPss(digest []byte, opts *rsa.PSSOptions, algorithm C.uchar) ([]byte, error) {
+	hash := opts.HashFunc()
+	if _, ok := hashOIDs[hash]; !ok {
+		return nil, fmt.Errorf("ykpiv: Sign: Unsupported algorithm")
+	}
+
+	var padLen int
+	switch algorithm {
+	case C.YKPIV_ALGO_RSA1024:
+		padLen = 128
+	case C.YKPIV_ALGO_RSA2048:
+		padLen = 256
+	default:
+		return nil, fmt.Errorf("ykpiv: Sign: Can't preform padding for signature, unknown algorithm")
+	}
+
+	modBits := s.PublicKey.(*rsa.PublicKey).N.BitLen()
+
+	saltLen := opts.SaltLength
+	switch saltLen {
+	case rsa.PSSSaltLengthAuto:
+		saltLen = (modBits-1+7)/8 - 2 - hash.Size()
+	case rsa.PSSSaltLengthEqualsHash:
+		saltLen = hash.Size()
+	}
+
+	computedDigest, err := pss.Encode(rand.Reader, hash, digest, saltLen, modBits, padLen)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.signRaw(computedDigest, algorithm)
+}
+
+// Pass a fully padded block to the chip for the raw RSA operation.
+func (s Slot) signRaw(computedDigest []byte, algorithm C.uchar) ([]byte, error) {
 	var cDigestLen = C.size_t(len(computedDigest))
 	var cDigest = (*C.uchar)(C.CBytes(computedDigest))
 	defer C.free(unsafe.Pointer(cDigest))
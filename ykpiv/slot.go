@@ -92,6 +92,15 @@ var (
 		Key:         C.YKPIV_KEY_KEYMGM,
 		Name:        "Key Management",
 	}
+
+	// Attestation, which holds the Yubico signed intermediate Certificate
+	// and key used to attest that keys in the other slots were generated
+	// on the device.
+	Attestation SlotId = SlotId{
+		Certificate: C.YKPIV_OBJ_ATTESTATION,
+		Key:         0xf9,
+		Name:        "Attestation",
+	}
 )
 
 // Slot abstracts a public key, private key, and x509 Certificate stored
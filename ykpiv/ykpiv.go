@@ -223,6 +223,24 @@ func (y Yubikey) PINRetries() (int, error) {
 	return y.verify(nil)
 }
 
+// PIN Retries without a verify attempt. Reading the counter selects the
+// applet again which clears the PIN verification, the session is logged in
+// again before returning.
+func (y Yubikey) GetPINRetries() (int, error) {
+	tries := C.int(0)
+	err := getError(C.ykpiv_get_pin_retries(y.state, &tries),
+		"get_pin_retries")
+	if err != nil {
+		return -1, err
+	}
+
+	if err = y.Login(); err != nil {
+		return -1, err
+	}
+
+	return int(tries), nil
+}
+
 // Log into the Yubikey using the user PIN.
 func (y Yubikey) Login() error {
 	pin, err := y.options.GetPIN()
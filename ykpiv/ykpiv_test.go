@@ -359,6 +359,54 @@ func TestGenerateRSA2048(t *testing.T) {
 	}
 }
 
+func TestSignRSA(t *testing.T) {
+	isDestructive()
+
+	yubikey, closer, err := getYubikey(defaultPIN, defaultPUK)
+	isok(t, err)
+	defer closer()
+
+	isok(t, yubikey.Login())
+	isok(t, yubikey.Authenticate())
+
+	slot, err := yubikey.GenerateRSA(ykpiv.Authentication, 2048)
+	isok(t, err)
+
+	pubKey, ok := slot.PublicKey.(*rsa.PublicKey)
+	assert(t, ok, "invalid public key type")
+
+	for _, hf := range []struct {
+		newh func() hash.Hash
+		hash crypto.Hash
+	}{
+		{sha512.New, crypto.SHA512},
+		{sha256.New, crypto.SHA256},
+	} {
+		h := hf.newh()
+		_, err = h.Write([]byte("test"))
+		isok(t, err)
+		digest := h.Sum(nil)
+
+		sig, err := slot.Sign(nil, digest, hf.hash)
+		isok(t, err)
+
+		isok(t, rsa.VerifyPKCS1v15(pubKey, hf.hash, digest, sig))
+
+		pssOpts := &rsa.PSSOptions{
+			SaltLength: rsa.PSSSaltLengthEqualsHash,
+			Hash:       hf.hash,
+		}
+
+		sig, err = slot.Sign(nil, digest, pssOpts)
+		isok(t, err)
+
+		isok(t, rsa.VerifyPSS(pubKey, hf.hash, digest, sig, pssOpts))
+
+		_, err = slot.Sign(nil, digest[:16], hf.hash)
+		notok(t, err)
+	}
+}
+
 func TestSignEC(t *testing.T) {
 	isDestructive()
 
@@ -6,12 +6,15 @@ import (
 	"github.com/pritunl/pritunl-hsm/utils"
 	"github.com/pritunl/pritunl-hsm/ykpiv"
 	"golang.org/x/crypto/ssh"
+	"strings"
 )
 
 var (
-	keys     = map[string]*ykpiv.Yubikey{}
-	pubKeys  = map[string]string{}
-	keysLock = utils.NewMultiLock()
+	keys       = map[string]*ykpiv.Yubikey{}
+	pubKeys    = map[string]string{}
+	sshPubKeys = map[string]ssh.PublicKey{}
+	firmwares  = map[string]string{}
+	keysLock   = utils.NewMultiLock()
 )
 
 func GetKey(serial string) (key *ykpiv.Yubikey) {
@@ -32,6 +35,45 @@ func GetPublicKey(serial string) (pubKey string) {
 	return
 }
 
+func GetFirmware(serial string) (firmware string) {
+	// TODO
+	for _, firmware = range firmwares {
+		return
+	}
+
+	return
+}
+
+func GetSshPublicKeys() (pubKeys map[string]ssh.PublicKey) {
+	pubKeys = map[string]ssh.PublicKey{}
+
+	for serial, pubKey := range sshPubKeys {
+		pubKeys[serial] = pubKey
+	}
+
+	return
+}
+
+func ParseSlot(name string) (slotId ykpiv.SlotId, err error) {
+	switch strings.ToLower(name) {
+	case "9a", "authentication":
+		slotId = ykpiv.Authentication
+	case "9c", "signature":
+		slotId = ykpiv.Signature
+	case "9d", "key_management":
+		slotId = ykpiv.KeyManagement
+	case "9e", "card_authentication":
+		slotId = ykpiv.CardAuthentication
+	default:
+		err = &errortypes.ParseError{
+			errors.Newf("yubikey: Unknown slot '%s'", name),
+		}
+		return
+	}
+
+	return
+}
+
 func LockKey(serial string) {
 	keysLock.Lock(serial)
 }
@@ -40,9 +82,17 @@ func UnlockKey(serial string) {
 	keysLock.Unlock(serial)
 }
 
-func Init() (err error) {
+// Returns true if the key is in use, used to avoid waiting on the key for
+// non-essential operations
+func KeyLocked(serial string) bool {
+	return keysLock.Locked(serial)
+}
+
+func initKeys(login bool) (err error) {
 	ks := map[string]*ykpiv.Yubikey{}
 	pks := map[string]string{}
+	spks := map[string]ssh.PublicKey{}
+	fws := map[string]string{}
 
 	// TODO
 	pin := "123456"
@@ -55,9 +105,11 @@ func Init() (err error) {
 		return
 	}
 
-	err = yubikey.Login()
-	if err != nil {
-		return
+	if login {
+		err = yubikey.Login()
+		if err != nil {
+			return
+		}
 	}
 
 	slot, err := yubikey.Authentication()
@@ -73,11 +125,41 @@ func Init() (err error) {
 		return
 	}
 
+	version, err := yubikey.Version()
+	if err != nil {
+		return
+	}
+
 	ks["todo"] = yubikey
 	pks["todo"] = string(utils.MarshalPublicKey(pubKey))
+	spks["todo"] = pubKey
+	fws["todo"] = strings.TrimRight(string(version), "\x00")
 
 	keys = ks
 	pubKeys = pks
+	sshPubKeys = spks
+	firmwares = fws
+
+	return
+}
+
+func Init() (err error) {
+	err = initKeys(true)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// Loads the public keys without a PIN login, reading the slot certificates
+// does not require the PIN and does not change the PIN retry counter or the
+// session of a running service
+func InitPublic() (err error) {
+	err = initKeys(false)
+	if err != nil {
+		return
+	}
 
 	return
 }